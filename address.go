@@ -0,0 +1,193 @@
+package pgpmail
+
+import (
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"code.google.com/p/go.crypto/openpgp"
+)
+
+// AddressNormalization controls how email addresses are compared when
+// looking up keys.  The domain is always compared without regard to case,
+// and internationalized domain names are compared in their punycode form
+// so that "bücher.example" matches "xn--bcher-kva.example".
+type AddressNormalization struct {
+	// FoldLocalPart compares the part of the address before the @ without
+	// regard to case.  RFC 5321 allows the local part to be case
+	// sensitive but almost no mail system treats it so.
+	FoldLocalPart bool
+	// StripSubaddress removes a sub-address such as "+tag" from the local
+	// part, so that "user+tag@example.com" matches "user@example.com"
+	StripSubaddress bool
+	// SubaddressSeparators are the characters which start a sub-address.
+	// If empty "+" is used.
+	SubaddressSeparators string
+}
+
+// DefaultAddressNormalization folds the case of the whole address and
+// leaves sub-addresses in place.
+var DefaultAddressNormalization = AddressNormalization{FoldLocalPart: true}
+
+// Normalize returns the form of address used to compare it with other
+// addresses.  The address may include a display name in the form
+// "Name <user@example.com>".
+func (an AddressNormalization) Normalize(address string) string {
+	address = strings.TrimSpace(address)
+	if start := strings.LastIndex(address, "<"); start != -1 {
+		if end := strings.Index(address[start:], ">"); end != -1 {
+			address = strings.TrimSpace(address[start+1 : start+end])
+		}
+	}
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return strings.ToLower(address)
+	}
+	local, domain := address[:at], address[at+1:]
+	if an.StripSubaddress {
+		seps := an.SubaddressSeparators
+		if seps == "" {
+			seps = "+"
+		}
+		if idx := strings.IndexAny(local, seps); idx > 0 {
+			local = local[:idx]
+		}
+	}
+	if an.FoldLocalPart {
+		local = strings.ToLower(local)
+	}
+	return local + "@" + normalizeDomain(domain)
+}
+
+// normalizeDomain returns domain in lower case with each label which is
+// not ASCII converted to punycode.
+func normalizeDomain(domain string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(domain), "."), ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			if encoded, ok := punycode(label); ok {
+				labels[i] = "xn--" + encoded
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Parameters of the punycode encoding from RFC 3492
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// punycode encodes label as described in RFC 3492.  It returns false if
+// the label is too long to encode.
+func punycode(label string) (string, bool) {
+	runes := []rune(label)
+	out := make([]byte, 0, len(label)+8)
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for handled < len(runes) {
+		m := rune(0x7fffffff)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		if int(m-n) > (1<<31-1-delta)/(handled+1) {
+			return "", false
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out), true
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+// identityEmail returns the email address of a key identity.  User ids
+// which are a bare address, such as "user@example.com", have no Email
+// when parsed by the openpgp package, so the address is taken from the
+// whole user id.
+func identityEmail(id *openpgp.Identity) string {
+	if id.UserId == nil {
+		return ""
+	}
+	if id.UserId.Email != "" {
+		return id.UserId.Email
+	}
+	if a, err := mail.ParseAddress(id.UserId.Id); err == nil {
+		return a.Address
+	}
+	return ""
+}
@@ -0,0 +1,74 @@
+package pgpmail
+
+import (
+	"testing"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	strip := AddressNormalization{FoldLocalPart: true, StripSubaddress: true, SubaddressSeparators: "+-"}
+	tests := []struct {
+		an       AddressNormalization
+		address  string
+		expected string
+	}{
+		{DefaultAddressNormalization, "Alice@Example.COM", "alice@example.com"},
+		{DefaultAddressNormalization, " Alice <alice@example.com> ", "alice@example.com"},
+		{DefaultAddressNormalization, "user+tag@example.com", "user+tag@example.com"},
+		{DefaultAddressNormalization, "user@example.com.", "user@example.com"},
+		{DefaultAddressNormalization, "user@Bücher.example", "user@xn--bcher-kva.example"},
+		{DefaultAddressNormalization, "user@xn--bcher-kva.example", "user@xn--bcher-kva.example"},
+		{DefaultAddressNormalization, "user@MÜNCHEN.de", "user@xn--mnchen-3ya.de"},
+		{AddressNormalization{}, "Alice@Example.COM", "Alice@example.com"},
+		{strip, "User+tag@example.com", "user@example.com"},
+		{strip, "user-tag@example.com", "user@example.com"},
+		{strip, "+user@example.com", "+user@example.com"},
+		{AddressNormalization{StripSubaddress: true}, "user+a-b@example.com", "user@example.com"},
+	}
+	for _, tt := range tests {
+		if n := tt.an.Normalize(tt.address); n != tt.expected {
+			t.Errorf("normalizing %q: expecting %q, got %q", tt.address, tt.expected, n)
+		}
+	}
+}
+
+func TestPunycode(t *testing.T) {
+	// Samples from RFC 3492 section 7.1
+	tests := map[string]string{
+		"ü":         "tda",
+		"bücher":    "bcher-kva",
+		"他们为什么不说中文": "ihqwcrb4cv8a8dqg056pqjye",
+		"3年b組金八先生":  "3b-ww4c5e180e575a65lsy2b",
+	}
+	for label, expected := range tests {
+		if p, ok := punycode(label); !ok || p != expected {
+			t.Errorf("punycode of %q: expecting %q, got %q", label, expected, p)
+		}
+	}
+}
+
+func TestKeyRingNormalizedLookup(t *testing.T) {
+	kr := createTestKeyRing()
+	k, _ := kr.GetPublicKey("user1@example.com")
+	if k2, _ := kr.GetPublicKey("User1@Example.COM"); k2 != k {
+		t.Error("key not found by address with different case")
+	}
+	if k2, _ := kr.GetPublicKey("user1+lists@example.com"); k2 != nil {
+		t.Error("sub-address matched without StripSubaddress")
+	}
+	kr.SetAddressNormalization(AddressNormalization{FoldLocalPart: true, StripSubaddress: true})
+	if k2, _ := kr.GetPublicKey("user1+lists@example.com"); k2 != k {
+		t.Error("key not found by sub-address")
+	}
+
+	// A user id which is a bare address
+	bare := copyEntity(k)
+	uid := packet.NewUserId("bare@Example.com", "", "")
+	bare.Identities = map[string]*openpgp.Identity{uid.Id: {Name: uid.Id, UserId: uid}}
+	kr.Replace(bare)
+	if k2, _ := kr.GetPublicKey("bare@example.com"); k2 != bare {
+		t.Error("key not found by user id without angle brackets")
+	}
+}
@@ -0,0 +1,119 @@
+package pgpmail
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+)
+
+// An Attachment describes a section of a message which carries a file
+// rather than message text.
+type Attachment struct {
+	// Filename is taken from the Content-Disposition filename parameter or
+	// the Content-Type name parameter, and may be empty.
+	Filename string
+	// MediaType is the media type of the attachment without parameters
+	MediaType string
+	// Path locates the attachment in the message tree as described for Walk
+	Path []int
+	// Part is the message section containing the attachment
+	Part *MessagePart
+	// limits are applied when the content is decoded by Open
+	limits Limits
+}
+
+// Open returns a reader for the transfer decoded content of the attachment.
+// The content is decoded as it is read, and reading fails with a
+// LimitExceededError once more than the MaxDecodedSize limit has been
+// decoded.
+func (a *Attachment) Open() (io.Reader, error) {
+	return a.Part.decodedReader(a.limits)
+}
+
+// Size returns the size of the attachment content after transfer decoding,
+// or -1 if the content cannot be decoded.  The content is decoded without
+// being kept each time Size is called.
+func (a *Attachment) Size() int64 {
+	r, err := a.Part.decodedReader(Limits{})
+	if err != nil {
+		return -1
+	}
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// Attachments returns every section of m, at any depth, which is marked as
+// an attachment by its Content-Disposition or which has a filename.
+func (m *MessagePart) Attachments() []*Attachment {
+	return m.attachments(DefaultOptions().Limits)
+}
+
+func (m *MessagePart) attachments(limits Limits) []*Attachment {
+	var as []*Attachment
+	m.Walk(func(path []int, p *MessagePart) error {
+		if p.IsMultipart() || !isAttachmentPart(p) {
+			return nil
+		}
+		as = append(as, newAttachment(path, p, limits))
+		return nil
+	})
+	return as
+}
+
+func newAttachment(path []int, p *MessagePart, limits Limits) *Attachment {
+	a := new(Attachment)
+	a.Filename = attachmentFilename(p)
+	a.MediaType = p.MediaType()
+	if a.MediaType == "" {
+		a.MediaType = "application/octet-stream"
+	}
+	a.Path = path
+	a.Part = p
+	a.limits = limits
+	return a
+}
+
+func isAttachmentPart(p *MessagePart) bool {
+	disposition, _ := parseContentDisposition(p)
+	if disposition == "attachment" {
+		return true
+	}
+	return attachmentFilename(p) != ""
+}
+
+// parseContentDisposition returns the disposition type of p in lower case
+// and its parameters.  RFC 2231 parameter continuations and charsets are
+// decoded.
+func parseContentDisposition(p *MessagePart) (string, map[string]string) {
+	cd := p.GetHeaderValue("Content-Disposition")
+	if cd == "" {
+		return "", nil
+	}
+	disposition, params, err := mime.ParseMediaType(cd)
+	if err != nil {
+		logger.Warning("Error parsing content disposition '" + cd + "' : " + err.Error())
+		idx := strings.Index(cd, ";")
+		if idx == -1 {
+			idx = len(cd)
+		}
+		return strings.ToLower(strings.TrimSpace(cd[:idx])), nil
+	}
+	return disposition, params
+}
+
+func attachmentFilename(p *MessagePart) string {
+	_, params := parseContentDisposition(p)
+	name := params["filename"]
+	if name == "" {
+		name = p.ContentTypeParam("name")
+	}
+	// Some clients encode filenames with RFC 2047 rather than RFC 2231
+	if decoded, err := headerDecoder.DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	return name
+}
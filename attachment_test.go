@@ -0,0 +1,119 @@
+package pgpmail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+var continuedNamePart = `Content-Type: application/pdf;
+	name*0*=UTF-8''Gr%C3%BC%C3%9Fe;
+	name*1=".pdf"
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQK`
+
+var encodedNamePart = `Content-Type: image/png; name="=?UTF-8?Q?b=C3=BCro.png?="
+Content-Disposition: inline
+Content-Transfer-Encoding: base64
+
+iVBORw0KGgo=`
+
+func TestAttachments(t *testing.T) {
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{nestedAlternativePart, attachmentPart, continuedNamePart}
+	td.Parts[0] = nestedAlternativePart[:len(nestedAlternativePart)-len("--nested0123--")] +
+		"--nested0123\n" + encodedNamePart + "\n--nested0123--"
+	m := td.Message()
+
+	as := m.Attachments()
+	if len(as) != 3 {
+		t.Fatalf("expecting 3 attachments, got %d", len(as))
+	}
+	expected := []struct {
+		filename, mediaType string
+		size                int64
+		path                string
+	}{
+		{"büro.png", "image/png", 8, "[0 2]"},
+		{"data.bin", "application/octet-stream", 15, "[1]"},
+		{"Grüße.pdf", "application/pdf", 9, "[2]"},
+	}
+	for i, e := range expected {
+		a := as[i]
+		if a.Filename != e.filename || a.MediaType != e.mediaType || a.Size() != e.size {
+			t.Errorf("attachment %d does not match: %q %s %d", i, a.Filename, a.MediaType, a.Size())
+		}
+		if fmt.Sprint(a.Path) != e.path {
+			t.Errorf("attachment %d has unexpected path %v", i, a.Path)
+		}
+	}
+	r, err := as[1].Open()
+	if err != nil {
+		t.Fatal("error opening attachment: " + err.Error())
+	}
+	data, _ := ioutil.ReadAll(r)
+	if string(data) != "attachment data" {
+		t.Errorf("attachment content does not match: %q", data)
+	}
+}
+
+func TestAttachmentsNone(t *testing.T) {
+	td := new(TestData)
+	td.MultipartType = "alternative"
+	td.Parts = []string{plainPart, htmlPart}
+	if as := td.Message().Attachments(); len(as) != 0 {
+		t.Errorf("expecting no attachments, got %d", len(as))
+	}
+}
+
+func TestAttachmentBadEncoding(t *testing.T) {
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{plainPart, `Content-Type: application/octet-stream; name="bad.bin"
+Content-Transfer-Encoding: base64
+
+not base64!`}
+	as := td.Message().Attachments()
+	if len(as) != 1 {
+		t.Fatalf("expecting 1 attachment, got %d", len(as))
+	}
+	if as[0].Size() != -1 {
+		t.Errorf("expecting size -1 for undecodable attachment, got %d", as[0].Size())
+	}
+	r, err := as[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("expecting error reading undecodable attachment")
+	}
+}
+
+func TestAttachmentLimit(t *testing.T) {
+	defer SetParserLimits(DefaultLimits)
+	SetParserLimits(Limits{MaxDecodedSize: 10})
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{plainPart, `Content-Type: application/octet-stream; name="big.bin"
+Content-Transfer-Encoding: base64
+
+` + encodeBase64Lines(make([]byte, 100))}
+	as := td.Message().Attachments()
+	if len(as) != 1 {
+		t.Fatalf("expecting 1 attachment, got %d", len(as))
+	}
+	if as[0].Size() != 100 {
+		t.Errorf("expecting size 100 regardless of limits, got %d", as[0].Size())
+	}
+	r, err := as[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	expectLimitError(t, err, "MaxDecodedSize")
+	if len(data) != 10 {
+		t.Errorf("expecting content up to the limit, got %d bytes", len(data))
+	}
+}
@@ -0,0 +1,175 @@
+package pgpmail
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maximum line length of a 7bit text body, not including CRLF (RFC 5322)
+const maxLineLength = 998
+
+// A Builder composes a new message from text, HTML and attachments.  The
+// resulting Message may be passed to Sign or Encrypt.
+type Builder struct {
+	From    string
+	To      []string
+	Cc      []string
+	Subject string
+	// Text is the text/plain body of the message
+	Text string
+	// HTML is the text/html body of the message.  If both Text and HTML
+	// are set the message body is multipart/alternative.
+	HTML string
+
+	// Options supplies the clock used for the Date header.  If it is nil
+	// DefaultOptions is used.
+	Options *Options
+
+	headers     []*Header
+	attachments []*MessagePart
+}
+
+// AddHeader adds an additional header to the message being built.
+func (b *Builder) AddHeader(name, value string) {
+	b.headers = append(b.headers, &Header{Name: CanonicalMIMEHeaderKey(name), Value: value})
+}
+
+// AddAttachment adds a file to the message being built.  If mediaType is
+// empty it is guessed from the filename extension.  mediaType may include
+// parameters such as charset.
+func (b *Builder) AddAttachment(filename, mediaType string, data []byte) {
+	if mediaType == "" {
+		mediaType = mime.TypeByExtension(filepath.Ext(filename))
+	}
+	p := new(MessagePart)
+	p.AddHeader(ctHeader, attachmentContentType(mediaType, filename))
+	p.AddHeader("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	p.SetDecodedBody(data, EncodingBase64)
+	// The line ending before the next boundary belongs to the boundary
+	p.Body = strings.TrimSuffix(p.Body, "\r\n")
+	p.parseContentType()
+	p.rawContent = []byte(p.String())
+	b.attachments = append(b.attachments, p)
+}
+
+// attachmentContentType returns a Content-Type value for mediaType with a
+// name parameter for filename, using application/octet-stream if
+// mediaType is empty or cannot be parsed.
+func attachmentContentType(mediaType, filename string) string {
+	mt, params, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		mt, params = "application/octet-stream", make(map[string]string)
+	}
+	params["name"] = filename
+	if ct := mime.FormatMediaType(mt, params); ct != "" {
+		return ct
+	}
+	return mime.FormatMediaType("application/octet-stream", map[string]string{"name": filename})
+}
+
+// Build creates a new Message with Date, Message-Id and Mime-Version headers
+// and a body structured according to the content added to the Builder.
+func (b *Builder) Build() (*Message, error) {
+	if b.From == "" {
+		return nil, errors.New("cannot build message, no sender address")
+	}
+	opts := b.Options
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	m := new(Message)
+	m.AddHeader("Date", opts.Config.Now().Format(time.RFC1123Z))
+	m.AddHeader("Message-Id", createMessageId(b.From))
+	m.AddEncodedHeader("From", b.From)
+	if len(b.To) > 0 {
+		m.AddEncodedHeader("To", strings.Join(b.To, ", "))
+	}
+	if len(b.Cc) > 0 {
+		m.AddEncodedHeader("Cc", strings.Join(b.Cc, ", "))
+	}
+	if b.Subject != "" {
+		m.AddEncodedHeader("Subject", b.Subject)
+	}
+	m.AddHeader("Mime-Version", "1.0")
+	m.HeaderList = append(m.HeaderList, b.headers...)
+
+	body := b.buildBody()
+	m.HeaderList = append(m.HeaderList, body.HeaderList...)
+	m.Body = body.Body
+	m.mpContent = body.mpContent
+	m.parseContentType()
+	m.rawContent = []byte(m.String())
+	return m, nil
+}
+
+func (b *Builder) buildBody() *MessagePart {
+	var content []*MessagePart
+	if b.Text != "" || b.HTML == "" {
+		content = append(content, createTextPart("plain", b.Text))
+	}
+	if b.HTML != "" {
+		content = append(content, createTextPart("html", b.HTML))
+	}
+	body := content[0]
+	if len(content) > 1 {
+		body = createMultipart("alternative", content)
+	}
+	if len(b.attachments) == 0 {
+		return body
+	}
+	if b.Text == "" && b.HTML == "" {
+		return createMultipart("mixed", b.attachments)
+	}
+	return createMultipart("mixed", append([]*MessagePart{body}, b.attachments...))
+}
+
+func createTextPart(subtype, text string) *MessagePart {
+	p := new(MessagePart)
+	p.AddHeader(ctHeader, "text/"+subtype+"; charset=utf-8")
+	data := []byte(insertCR(text))
+	if is7Bit(data) && !hasLongLines(data) {
+		p.SetDecodedBody(data, Encoding7Bit)
+	} else {
+		p.SetDecodedBody(data, EncodingQuotedPrintable)
+	}
+	p.parseContentType()
+	p.rawContent = []byte(p.String())
+	return p
+}
+
+func createMultipart(subtype string, parts []*MessagePart) *MessagePart {
+	p := new(MessagePart)
+	boundary := randomBoundary()
+	p.AddHeader(ctHeader, fmt.Sprintf("multipart/%s; boundary=%s", subtype, boundary))
+	p.parseContentType()
+	p.mpContent = newMultipartContent(boundary, "")
+	for _, part := range parts {
+		p.mpContent.addPart(part)
+	}
+	p.PackMultiparts()
+	p.rawContent = []byte(p.String())
+	return p
+}
+
+func createMessageId(from string) string {
+	domain := "localhost"
+	if as, err := addressParser.ParseList(from); err == nil && len(as) > 0 {
+		if idx := strings.LastIndex(as[0].Address, "@"); idx != -1 {
+			domain = as[0].Address[idx+1:]
+		}
+	}
+	return "<" + randomBoundary() + "@" + domain + ">"
+}
+
+func hasLongLines(data []byte) bool {
+	for _, line := range strings.Split(string(data), "\r\n") {
+		if len(line) > maxLineLength {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package pgpmail
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestBuildText(t *testing.T) {
+	b := new(Builder)
+	b.From = "User One <user1@example.com>"
+	b.To = []string{"user2@example.com"}
+	b.Subject = "Test Built Message"
+	b.Text = "This is a test message.\n"
+	m, err := b.Build()
+	if err != nil {
+		t.Fatal("error building message: " + err.Error())
+	}
+	for _, h := range []string{"Date", "Message-Id", "Mime-Version", "From", "To", "Subject"} {
+		if m.GetHeaderValue(h) == "" {
+			t.Errorf("built message has no %s header", h)
+		}
+	}
+	if !strings.HasSuffix(m.GetHeaderValue("Message-Id"), "@example.com>") {
+		t.Errorf("Message-Id does not use sender domain: %s", m.GetHeaderValue("Message-Id"))
+	}
+	if m.MediaType() != "text/plain" || m.Body != "This is a test message.\r\n" {
+		t.Errorf("built message body does not match: %s %q", m.MediaType(), m.Body)
+	}
+
+	if st := m.Sign(testKeys, ""); st.Code != StatusSignedOnly {
+		t.Fatalf("built message did not sign: %v", st.Code)
+	}
+	m, _ = ParseMessage(m.String())
+	if st := m.Verify(testKeys); st.Code != VerifySigValid {
+		t.Errorf("signature on built message did not verify: %v", st.Code)
+	}
+}
+
+func TestBuildMixed(t *testing.T) {
+	b := new(Builder)
+	b.From = "user1@example.com"
+	b.To = []string{"Zoë <user1@example.com>"}
+	b.Subject = "Grüße"
+	b.Text = "Plain text with ümlauts.\n"
+	b.HTML = "<p>HTML text</p>\n"
+	b.AddHeader("x-mailer", "pgpmail")
+	b.AddAttachment("notes.pdf", "", []byte("attached notes"))
+	b.AddAttachment("data.bin", "", []byte{0, 1, 2, 3})
+	m, err := b.Build()
+	if err != nil {
+		t.Fatal("error building message: " + err.Error())
+	}
+
+	m, err = ParseMessage(m.String())
+	if err != nil {
+		t.Fatal("error parsing built message: " + err.Error())
+	}
+	if m.GetDecodedHeader("Subject") != "Grüße" || m.GetHeaderValue("X-Mailer") != "pgpmail" {
+		t.Error("built message headers do not match")
+	}
+	if m.MediaType() != "multipart/mixed" || len(m.Parts()) != 3 {
+		t.Fatalf("unexpected structure for built message: %s with %d parts", m.MediaType(), len(m.Parts()))
+	}
+	alt := m.Parts()[0]
+	if alt.MediaType() != "multipart/alternative" || len(alt.Parts()) != 2 {
+		t.Fatal("built message does not contain multipart/alternative body")
+	}
+	text, _, _ := alt.Parts()[0].Text()
+	if text != "Plain text with ümlauts.\r\n" {
+		t.Errorf("text part does not match: %q", text)
+	}
+	as := m.Attachments()
+	if len(as) != 2 || as[0].Filename != "notes.pdf" || as[1].MediaType != "application/octet-stream" {
+		t.Fatalf("attachments of built message do not match")
+	}
+	if as[0].MediaType != "application/pdf" {
+		t.Errorf("attachment media type not guessed from filename: %s", as[0].MediaType)
+	}
+	r, _ := as[1].Open()
+	if data, _ := ioutil.ReadAll(r); string(data) != "\x00\x01\x02\x03" {
+		t.Errorf("attachment content does not match: %q", data)
+	}
+
+	if st := m.Encrypt(testKeys); st.Code != StatusEncryptedOnly {
+		t.Fatalf("built message did not encrypt: %v %s", st.Code, st.FailureMessage)
+	}
+	if st := m.Decrypt(testKeys); st.Code != DecryptSuccess {
+		t.Fatalf("built message did not decrypt: %v", st.Code)
+	}
+	if len(m.Attachments()) != 2 {
+		t.Error("attachments not present in decrypted message")
+	}
+}
+
+func TestBuildNoSender(t *testing.T) {
+	b := new(Builder)
+	b.Text = "No sender"
+	if _, err := b.Build(); err == nil {
+		t.Error("expecting error building message without sender")
+	}
+}
+
+func TestBuildTextAttachment(t *testing.T) {
+	b := new(Builder)
+	b.From = "user1@example.com"
+	b.Text = "See attached.\n"
+	b.AddAttachment("readme.txt", "", []byte("read me\n"))
+	m, err := b.Build()
+	if err != nil {
+		t.Fatal("error building message: " + err.Error())
+	}
+	p := m.Parts()[1]
+	if p.MediaType() != "text/plain" || p.ContentTypeParam("name") != "readme.txt" {
+		t.Errorf("unexpected content type for text attachment: %q", p.GetHeaderValue("Content-Type"))
+	}
+	if !strings.Contains(m.String(), "cmVhZCBtZQo=\r\n--") {
+		t.Error("blank line added after attachment body")
+	}
+	as := m.Attachments()
+	if len(as) != 1 || as[0].Filename != "readme.txt" {
+		t.Fatal("text attachment not found in built message")
+	}
+	r, _ := as[0].Open()
+	if data, _ := ioutil.ReadAll(r); string(data) != "read me\n" {
+		t.Errorf("attachment content does not match: %q", data)
+	}
+}
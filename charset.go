@@ -0,0 +1,171 @@
+package pgpmail
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// The charset assumed for text parts without a charset parameter (RFC 2045)
+const defaultCharset = "us-ascii"
+
+// UnsupportedCharsetError is returned when text is in a charset which
+// cannot be converted to UTF-8.
+type UnsupportedCharsetError string
+
+func (e UnsupportedCharsetError) Error() string {
+	return "unsupported charset: " + string(e)
+}
+
+type charsetDecoder func(data []byte) string
+
+var charsetDecoders = map[string]charsetDecoder{
+	"utf-8":        decodeUTF8,
+	"us-ascii":     decodeUTF8,
+	"iso-8859-1":   latin1.decode,
+	"iso-8859-15":  latin9.decode,
+	"windows-1252": windows1252.decode,
+}
+
+var charsetAliases = map[string]string{
+	"utf8":        "utf-8",
+	"ascii":       "us-ascii",
+	"iso8859-1":   "iso-8859-1",
+	"iso_8859-1":  "iso-8859-1",
+	"latin1":      "iso-8859-1",
+	"l1":          "iso-8859-1",
+	"iso8859-15":  "iso-8859-15",
+	"iso_8859-15": "iso-8859-15",
+	"latin9":      "iso-8859-15",
+	"latin-9":     "iso-8859-15",
+	"cp1252":      "windows-1252",
+	"x-cp1252":    "windows-1252",
+}
+
+func init() {
+	headerDecoder.CharsetReader = charsetReader
+}
+
+// Text returns the decoded body of a text part converted to UTF-8 from the
+// charset named by the charset parameter of its Content-Type, and the name
+// of the charset which was used.  Parts without a charset parameter are
+// assumed to be us-ascii, and any bytes which are not valid in the charset
+// are replaced with the Unicode replacement character.
+func (m *MessagePart) Text() (string, string, error) {
+	data, err := m.DecodedBody()
+	if err != nil {
+		return "", "", err
+	}
+	charset := normalizeCharset(m.ContentTypeParam("charset"))
+	if charset == "" {
+		charset = defaultCharset
+	}
+	text, err := decodeCharset(charset, data)
+	if err != nil {
+		return "", "", err
+	}
+	return text, charset, nil
+}
+
+func decodeCharset(charset string, data []byte) (string, error) {
+	dec, ok := charsetDecoders[normalizeCharset(charset)]
+	if !ok {
+		return "", UnsupportedCharsetError(charset)
+	}
+	return dec(data), nil
+}
+
+// charsetReader is used to decode RFC 2047 encoded-words in charsets other
+// than those the mime package understands.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	text, err := decodeCharset(charset, data)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(text), nil
+}
+
+func normalizeCharset(charset string) string {
+	charset = strings.ToLower(strings.Trim(charset, " \t\""))
+	if alias, ok := charsetAliases[charset]; ok {
+		return alias
+	}
+	return charset
+}
+
+// setContentTypeParam sets a parameter of the Content-Type header of p,
+// creating a text/plain Content-Type if p does not have one.
+func setContentTypeParam(p *MessagePart, name, value string) {
+	mt := p.MediaType()
+	params := make(map[string]string)
+	for k, v := range p.ctParams {
+		params[k] = v
+	}
+	if mt == "" {
+		mt = "text/plain"
+	}
+	params[strings.ToLower(name)] = value
+	p.SetHeader(ctHeader, mime.FormatMediaType(mt, params))
+	p.parseContentType()
+}
+
+func decodeUTF8(data []byte) string {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	b := new(bytes.Buffer)
+	for len(data) > 0 {
+		r, n := utf8.DecodeRune(data)
+		b.WriteRune(r)
+		data = data[n:]
+	}
+	return b.String()
+}
+
+// singleByteCharset maps each byte of an 8-bit charset to a rune
+type singleByteCharset [256]rune
+
+func (cs *singleByteCharset) decode(data []byte) string {
+	b := new(bytes.Buffer)
+	for _, c := range data {
+		b.WriteRune(cs[c])
+	}
+	return b.String()
+}
+
+// newSingleByteCharset returns a charset which is ISO-8859-1 except for the
+// given code points.
+func newSingleByteCharset(overrides map[byte]rune) *singleByteCharset {
+	cs := new(singleByteCharset)
+	for i := range cs {
+		cs[i] = rune(i)
+	}
+	for c, r := range overrides {
+		cs[c] = r
+	}
+	return cs
+}
+
+var latin1 = newSingleByteCharset(nil)
+
+var latin9 = newSingleByteCharset(map[byte]rune{
+	0xA4: '€', 0xA6: 'Š', 0xA8: 'š', 0xB4: 'Ž',
+	0xB8: 'ž', 0xBC: 'Œ', 0xBD: 'œ', 0xBE: 'Ÿ',
+})
+
+var windows1252 = newSingleByteCharset(map[byte]rune{
+	0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„',
+	0x85: '…', 0x86: '†', 0x87: '‡', 0x88: 'ˆ',
+	0x89: '‰', 0x8A: 'Š', 0x8B: '‹', 0x8C: 'Œ',
+	0x8E: 'Ž', 0x91: '‘', 0x92: '’', 0x93: '“',
+	0x94: '”', 0x95: '•', 0x96: '–', 0x97: '—',
+	0x98: '˜', 0x99: '™', 0x9A: 'š', 0x9B: '›',
+	0x9C: 'œ', 0x9E: 'ž', 0x9F: 'Ÿ',
+})
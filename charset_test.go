@@ -0,0 +1,80 @@
+package pgpmail
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestText(t *testing.T) {
+	p := new(MessagePart)
+	p.AddHeader(ctHeader, "text/plain; charset=ISO-8859-1")
+	p.AddHeader(cteHeader, "quoted-printable")
+	p.Body = "Gr=FC=DFe aus K=F6ln"
+	p.parseContentType()
+	text, charset, err := p.Text()
+	if err != nil {
+		t.Fatal("error extracting text: " + err.Error())
+	}
+	if text != "Grüße aus Köln" || charset != "iso-8859-1" {
+		t.Errorf("ISO-8859-1 text not converted correctly: %q (%s)", text, charset)
+	}
+
+	p.SetHeader(ctHeader, "text/plain; charset=cp1252")
+	p.SetHeader(cteHeader, "8bit")
+	p.Body = "\x93quoted\x94 \x80 5"
+	p.parseContentType()
+	text, charset, _ = p.Text()
+	if text != "“quoted” € 5" || charset != "windows-1252" {
+		t.Errorf("Windows-1252 text not converted correctly: %q (%s)", text, charset)
+	}
+
+	p.SetHeader(ctHeader, "text/plain")
+	p.Body = "caf\xe9"
+	p.parseContentType()
+	text, charset, _ = p.Text()
+	if text != "caf�" || charset != "us-ascii" {
+		t.Errorf("invalid bytes not replaced in default charset: %q (%s)", text, charset)
+	}
+
+	p.SetHeader(ctHeader, "text/plain; charset=x-unknown")
+	p.parseContentType()
+	if _, _, err := p.Text(); err == nil {
+		t.Error("expecting error for unsupported charset")
+	} else if _, ok := err.(UnsupportedCharsetError); !ok {
+		t.Errorf("expecting UnsupportedCharsetError, got %v", err)
+	}
+}
+
+func TestDecodedHeaderCharset(t *testing.T) {
+	td := new(TestData)
+	td.From = "=?windows-1252?Q?=93Boss=94?= <boss@example.com>"
+	td.Subject = "=?iso-8859-15?Q?Preis:_5_=A4?="
+	m := td.Message()
+	if s := m.GetDecodedHeader("Subject"); s != "Preis: 5 €" {
+		t.Errorf("ISO-8859-15 subject not decoded correctly: %q", s)
+	}
+	if a := getSenderAddress(m); a != "boss@example.com" {
+		t.Errorf("sender address not parsed from Windows-1252 display name: %q", a)
+	}
+}
+
+func TestInlineDecryptArmorCharset(t *testing.T) {
+	td := new(TestData)
+	td.Body = strings.Replace(testInlineCiphertext, "MESSAGE-----\n", "MESSAGE-----\nCharset: ISO-8859-1\n", 1)
+	m := td.Message()
+
+	status := m.Decrypt(testKeys)
+	if status.Code != DecryptSuccess {
+		t.Fatal("Inline encrypted message with armor charset did not decrypt successfully")
+	}
+	text, charset, err := m.Text()
+	if err != nil {
+		t.Fatal("error extracting decrypted text: " + err.Error())
+	}
+	if charset != "iso-8859-1" {
+		t.Errorf("armor charset was not used for decrypted text, got %s", charset)
+	}
+	if text != "This is a test inline message.\r\n\r\n" {
+		t.Errorf("decrypted text does not match: %q", text)
+	}
+}
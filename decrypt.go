@@ -30,6 +30,9 @@ type DecryptionStatus struct {
 	Message        *Message
 	KeyIds         []uint64
 	FailureMessage string
+	// Embedded holds the status of each message/rfc822 part when
+	// processing of embedded messages is enabled
+	Embedded []*DecryptionStatus
 }
 
 func (m *Message) Decrypt(keysrc KeySource) *DecryptionStatus {
@@ -37,12 +40,22 @@ func (m *Message) Decrypt(keysrc KeySource) *DecryptionStatus {
 }
 
 func (m *Message) DecryptWith(keysrc KeySource, passphrase []byte) *DecryptionStatus {
+	return decryptMessage(m, keysrc, passphrase, DefaultOptions())
+}
+
+func decryptMessage(m *Message, keysrc KeySource, passphrase []byte, opts *Options) *DecryptionStatus {
+	var status *DecryptionStatus
 	if m.IsMultipart() && m.ctSecondary == "encrypted" {
-		return decryptMimeMessage(m, keysrc, passphrase)
-	} else if processInlineEncrypted {
-		return decryptInlineMessage(m, keysrc, passphrase)
+		status = decryptMimeMessage(m, keysrc, passphrase, opts)
+	} else if opts.ProcessInlineEncrypted {
+		status = decryptInlineMessage(m, keysrc, passphrase, opts)
+	} else {
+		status = new(DecryptionStatus)
 	}
-	return new(DecryptionStatus)
+	if opts.ProcessEmbeddedMessages {
+		status.Embedded = decryptEmbeddedMessages(m, keysrc, passphrase, opts)
+	}
+	return status
 }
 
 func createFailureStatus(message string) *DecryptionStatus {
@@ -52,8 +65,8 @@ func createFailureStatus(message string) *DecryptionStatus {
 	return status
 }
 
-func decryptMimeMessage(m *Message, keysrc KeySource, passphrase []byte) *DecryptionStatus {
-	parts := m.mpContent.parts
+func decryptMimeMessage(m *Message, keysrc KeySource, passphrase []byte, opts *Options) *DecryptionStatus {
+	parts := m.Parts()
 	if len(parts) != 2 {
 		return createFailureStatus(fmt.Sprintf("failed to extract encrypted body, expecting 2 mime parts, got %d", len(parts)))
 	}
@@ -62,11 +75,11 @@ func decryptMimeMessage(m *Message, keysrc KeySource, passphrase []byte) *Decryp
 		return createFailureStatus("armor decode of encrypted body failed: " + err.Error())
 	}
 
-	bs, status := decryptCiphertext(keysrc, block.Body, passphrase)
+	bs, status := decryptCiphertext(keysrc, block.Body, passphrase, opts)
 	if bs == nil {
 		return status
 	}
-	err = processMimePlaintext(m, bs)
+	err = processMimePlaintext(m, bs, opts.Limits)
 	if err != nil {
 		status.Code = DecryptFailed
 		status.FailureMessage = "error building plaintext message: " + err.Error()
@@ -76,7 +89,7 @@ func decryptMimeMessage(m *Message, keysrc KeySource, passphrase []byte) *Decryp
 	return status
 }
 
-func processSignature(md *openpgp.MessageDetails, status *DecryptionStatus) {
+func processSignature(md *openpgp.MessageDetails, status *DecryptionStatus, now time.Time) {
 	if !md.IsSigned {
 		return
 	}
@@ -96,7 +109,7 @@ func processSignature(md *openpgp.MessageDetails, status *DecryptionStatus) {
 		status.VerifyStatus.FailureMessage = "error verifying signature: " + md.SignatureError.Error()
 		return
 	}
-	if md.SignedBy.SelfSignature.KeyExpired(time.Now()) {
+	if md.SignedBy.SelfSignature.KeyExpired(now) {
 		status.VerifyStatus.Code = VerifyKeyExpired
 		return
 	}
@@ -104,17 +117,19 @@ func processSignature(md *openpgp.MessageDetails, status *DecryptionStatus) {
 
 }
 
-func decryptCiphertext(keysrc KeySource, ctext io.Reader, passphrase []byte) ([]byte, *DecryptionStatus) {
+func decryptCiphertext(keysrc KeySource, ctext io.Reader, passphrase []byte, opts *Options) ([]byte, *DecryptionStatus) {
 	status := new(DecryptionStatus)
-	md, err := openpgp.ReadMessage(ctext, keysrc.GetSecretKeyRing(), createPromptFunction(passphrase), openpgpConfig)
+	md, err := openpgp.ReadMessage(ctext, keysrc.GetSecretKeyRing(), createPromptFunction(passphrase), opts.Config)
 	if err == nil {
+		plaintext, err := opts.Limits.readLimited(md.UnverifiedBody)
+		if err != nil {
+			return nil, createFailureStatus("error reading decrypted message: " + err.Error())
+		}
 		status.Code = DecryptSuccess
-		b := new(bytes.Buffer)
-		b.ReadFrom(md.UnverifiedBody)
 		if md.IsSigned {
-			processSignature(md, status)
+			processSignature(md, status, opts.Config.Now())
 		}
-		return b.Bytes(), status
+		return plaintext, status
 	}
 	if err == pgperr.ErrKeyIncorrect {
 		status.Code = DecryptFailedNoPrivateKey
@@ -130,45 +145,73 @@ func decryptCiphertext(keysrc KeySource, ctext io.Reader, passphrase []byte) ([]
 	return nil, status
 }
 
-func decryptInlineMessage(m *Message, keysrc KeySource, passphrase []byte) *DecryptionStatus {
+func decryptInlineMessage(m *Message, keysrc KeySource, passphrase []byte, opts *Options) *DecryptionStatus {
 	if !m.IsMultipart() {
-		ctext, err := extractInlineBody(m.Body)
-		if err != nil {
-			return createFailureStatus("error extracting inline message: " + err.Error())
-		}
-		if ctext != nil {
-			bs, status := decryptCiphertext(keysrc, ctext, passphrase)
-			if bs == nil {
-				return status
-			}
-			m.Body = insertCR(string(bs))
+		status := decryptInlinePart(&m.MessagePart, keysrc, passphrase, opts)
+		if status.Code == DecryptSuccess {
 			status.Message = m
-			return status
 		}
-		return new(DecryptionStatus)
+		return status
 	}
 
-	for _, part := range m.mpContent.parts {
+	for _, part := range leafParts(&m.MessagePart) {
 		// XXX sanity check content type
-		ctext, err := extractInlineBody(part.Body)
-		if err != nil {
-			return createFailureStatus("error extracting inline message part: " + err.Error())
+		if opts.ProcessEmbeddedMessages && part.IsEmbeddedMessage() {
+			continue
 		}
-		if ctext != nil {
-			bs, status := decryptCiphertext(keysrc, ctext, passphrase)
-			if bs == nil {
-				return status
-			}
-			part.Body = insertCR(string(bs))
+		status := decryptInlinePart(part, keysrc, passphrase, opts)
+		if status.Code == DecryptNotEncrypted {
+			continue
+		}
+		if status.Code == DecryptSuccess {
 			part.rawContent = []byte(part.String())
 			m.PackMultiparts()
 			status.Message = m
-			return status
 		}
+		return status
 	}
 	return new(DecryptionStatus)
 }
 
+// decryptInlinePart decrypts the first inline PGP message found in the
+// decoded body of part and replaces the body with the plaintext.
+func decryptInlinePart(part *MessagePart, keysrc KeySource, passphrase []byte, opts *Options) *DecryptionStatus {
+	body, err := part.decodedBody(opts.Limits)
+	if err != nil {
+		return createFailureStatus("error decoding inline message part: " + err.Error())
+	}
+	block, err := extractInlineBody(string(body))
+	if err != nil {
+		return createFailureStatus("error extracting inline message: " + err.Error())
+	}
+	if block == nil {
+		return new(DecryptionStatus)
+	}
+	bs, status := decryptCiphertext(keysrc, block.Body, passphrase, opts)
+	if bs == nil {
+		return status
+	}
+	plaintext := convertLineEndings(string(bs), part.lineEnding())
+	if err := replaceDecodedBody(part, []byte(plaintext)); err != nil {
+		return createFailureStatus("error replacing inline message body: " + err.Error())
+	}
+	if charset := armorCharset(block); charset != "" {
+		setContentTypeParam(part, "charset", charset)
+	}
+	return status
+}
+
+// armorCharset returns the value of the Charset armor header which
+// describes the encoding of the armored plaintext, or "" if there is none.
+func armorCharset(block *armor.Block) string {
+	for k, v := range block.Header {
+		if strings.EqualFold(k, "Charset") {
+			return v
+		}
+	}
+	return ""
+}
+
 func createPromptFunction(passphrase []byte) openpgp.PromptFunction {
 	first := true
 	return func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
@@ -191,7 +234,7 @@ func createPromptFunction(passphrase []byte) openpgp.PromptFunction {
 }
 
 func extractEncryptedBodyMime(m *Message) (io.Reader, error) {
-	ps := m.mpContent.parts
+	ps := m.Parts()
 	if len(ps) != 2 {
 		return nil, fmt.Errorf("failed to extract encrypted body, expecting 2 mime parts, got %d", len(ps))
 	}
@@ -202,7 +245,7 @@ func extractEncryptedBodyMime(m *Message) (io.Reader, error) {
 	return block.Body, nil
 }
 
-func extractInlineBody(body string) (io.Reader, error) {
+func extractInlineBody(body string) (*armor.Block, error) {
 	start := strings.Index(body, beginPgpMessage)
 	if start == -1 {
 		return nil, nil
@@ -217,11 +260,14 @@ func extractInlineBody(body string) (io.Reader, error) {
 	if err != nil {
 		return nil, errors.New("armor decode of encrypted body failed: " + err.Error())
 	}
-	return block.Body, nil
+	return block, nil
 }
 
-func processMimePlaintext(m *Message, plaintext []byte) error {
+func processMimePlaintext(m *Message, plaintext []byte, limits Limits) error {
 	mimeReader := NewReader(string(plaintext))
+	mimeReader.Lenient = true
+	mimeReader.Limits = limits
+	mimeReader.depth = m.depth
 	headers, err := mimeReader.ReadMIMEHeader()
 	if err != nil {
 		return err
@@ -234,7 +280,10 @@ func processMimePlaintext(m *Message, plaintext []byte) error {
 		return err
 	}
 	m.Body = string(body)
+	m.mpContent = nil
 	m.parseContentType()
-	m.extractMultiparts()
+	if m.IsMultipart() {
+		return m.extractMultiparts(mimeReader.newParseContext(), nil)
+	}
 	return nil
 }
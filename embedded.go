@@ -0,0 +1,146 @@
+package pgpmail
+
+import "errors"
+
+// IsEmbeddedMessage returns true if m is a message/rfc822 part, such as a
+// forwarded message attached to another message.
+func (m *MessagePart) IsEmbeddedMessage() bool {
+	return m.ctPrimary == "message" && m.ctSecondary == "rfc822"
+}
+
+// EmbeddedMessage parses the body of a message/rfc822 part as a Message.
+// The message is parsed once and the same value is returned by later
+// calls.  Changes made to it are written back to m by
+// PackEmbeddedMessage.  Embedded messages count towards the MaxDepth
+// limit along with the multipart sections enclosing them.
+func (m *MessagePart) EmbeddedMessage() (*Message, error) {
+	return m.embeddedMessage(DefaultOptions().Limits)
+}
+
+// embeddedMessage is EmbeddedMessage parsing the message with limits.
+func (m *MessagePart) embeddedMessage(limits Limits) (*Message, error) {
+	if !m.IsEmbeddedMessage() {
+		return nil, errors.New("not a message/rfc822 part")
+	}
+	if m.embedded != nil {
+		return m.embedded, nil
+	}
+	if err := checkLimit("MaxDepth", limits.MaxDepth, m.depth+1); err != nil {
+		return nil, err
+	}
+	body, err := m.decodedBody(limits)
+	if err != nil {
+		return nil, err
+	}
+	r := NewReader(string(body))
+	r.Lenient = true
+	r.Limits = limits
+	r.depth = m.depth + 1
+	em, err := r.ReadMessage()
+	if _, ok := err.(*LimitExceededError); ok {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.New("error parsing embedded message: " + err.Error())
+	}
+	m.embedded = em
+	return em, nil
+}
+
+// PackEmbeddedMessage renders the Message returned by EmbeddedMessage into
+// the body of m.
+func (m *MessagePart) PackEmbeddedMessage() error {
+	_, err := m.packEmbeddedMessage(DefaultOptions().Limits)
+	return err
+}
+
+// packEmbeddedMessage replaces the body of m with the rendered embedded
+// message and reports whether the body changed.
+func (m *MessagePart) packEmbeddedMessage(limits Limits) (bool, error) {
+	if m.embedded == nil {
+		return false, errors.New("embedded message has not been parsed")
+	}
+	body, err := m.decodedBody(limits)
+	if err != nil {
+		return false, err
+	}
+	text := m.embedded.String()
+	if text == string(body) {
+		return false, nil
+	}
+	if err := replaceDecodedBody(m, []byte(text)); err != nil {
+		return false, err
+	}
+	m.rawContent = []byte(m.String())
+	return true, nil
+}
+
+// embeddedParts returns every message/rfc822 part in the tree of m.
+// Messages nested inside the embedded messages are not included.
+func embeddedParts(m *MessagePart) []*MessagePart {
+	var parts []*MessagePart
+	m.Walk(func(path []int, p *MessagePart) error {
+		if p.IsEmbeddedMessage() {
+			parts = append(parts, p)
+		}
+		return nil
+	})
+	return parts
+}
+
+// packEmbeddedParts writes the embedded messages of parts back into m,
+// repacking the multipart sections of m if any of them changed.
+func packEmbeddedParts(m *Message, parts []*MessagePart, limits Limits) error {
+	changed := false
+	for _, p := range parts {
+		if p.embedded == nil {
+			continue
+		}
+		c, err := p.packEmbeddedMessage(limits)
+		if err != nil {
+			return err
+		}
+		changed = changed || c
+	}
+	if changed && m.IsMultipart() {
+		return m.PackMultiparts()
+	}
+	return nil
+}
+
+// decryptEmbeddedMessages decrypts each message/rfc822 part of m and
+// writes any plaintext back into m.
+func decryptEmbeddedMessages(m *Message, keysrc KeySource, passphrase []byte, opts *Options) []*DecryptionStatus {
+	var statuses []*DecryptionStatus
+	parts := embeddedParts(&m.MessagePart)
+	for _, p := range parts {
+		em, err := p.embeddedMessage(opts.Limits)
+		if err != nil {
+			statuses = append(statuses, createFailureStatus(err.Error()))
+			continue
+		}
+		statuses = append(statuses, decryptMessage(em, keysrc, passphrase, opts))
+	}
+	if err := packEmbeddedParts(m, parts, opts.Limits); err != nil {
+		logger.Warning("error packing decrypted embedded messages: " + err.Error())
+	}
+	return statuses
+}
+
+// verifyEmbeddedMessages verifies the signature of each message/rfc822
+// part of m.
+func verifyEmbeddedMessages(m *Message, keysrc KeySource, opts *Options) []*VerifyStatus {
+	var statuses []*VerifyStatus
+	parts := embeddedParts(&m.MessagePart)
+	for _, p := range parts {
+		em, err := p.embeddedMessage(opts.Limits)
+		if err != nil {
+			statuses = append(statuses, createVerifyFailure(err.Error()))
+			continue
+		}
+		statuses = append(statuses, verifyMessage(em, keysrc, opts))
+	}
+	if err := packEmbeddedParts(m, parts, opts.Limits); err != nil {
+		logger.Warning("error packing verified embedded messages: " + err.Error())
+	}
+	return statuses
+}
@@ -0,0 +1,145 @@
+package pgpmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// Content-Transfer-Encoding values understood by DecodedBody and SetDecodedBody
+const (
+	Encoding7Bit            = "7bit"
+	Encoding8Bit            = "8bit"
+	EncodingBinary          = "binary"
+	EncodingQuotedPrintable = "quoted-printable"
+	EncodingBase64          = "base64"
+)
+
+// maximum length of an encoded base64 line, not including CRLF
+const base64LineLength = 76
+
+// TransferEncoding returns the Content-Transfer-Encoding of m in lower case,
+// or "7bit" if there is no such header.
+func (m *MessagePart) TransferEncoding() string {
+	cte := strings.ToLower(strings.TrimSpace(m.GetHeaderValue(cteHeader)))
+	if cte == "" {
+		return Encoding7Bit
+	}
+	return cte
+}
+
+// DecodedBody returns the content of Body with the Content-Transfer-Encoding
+// of m removed.
+func (m *MessagePart) DecodedBody() ([]byte, error) {
+	return m.decodedBody(DefaultOptions().Limits)
+}
+
+// decodedBody is DecodedBody applying limits to the decoded content.
+func (m *MessagePart) decodedBody(limits Limits) ([]byte, error) {
+	r, err := m.decodedReader(limits)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if _, ok := err.(*LimitExceededError); ok {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.New("error decoding " + m.TransferEncoding() + " body: " + err.Error())
+	}
+	return data, nil
+}
+
+// decodedReader returns a reader which removes the Content-Transfer-Encoding
+// of m from Body as it is read, failing with a LimitExceededError once more
+// than limits.MaxDecodedSize bytes have been decoded.
+func (m *MessagePart) decodedReader(limits Limits) (io.Reader, error) {
+	var r io.Reader
+	switch cte := m.TransferEncoding(); cte {
+	case Encoding7Bit, Encoding8Bit, EncodingBinary:
+		r = strings.NewReader(m.Body)
+	case EncodingQuotedPrintable:
+		r = quotedprintable.NewReader(strings.NewReader(m.Body))
+	case EncodingBase64:
+		r = base64.NewDecoder(base64.StdEncoding, strings.NewReader(stripWhitespace(m.Body)))
+	default:
+		return nil, errors.New("unsupported content transfer encoding: " + cte)
+	}
+	return limits.limitReader(r), nil
+}
+
+// SetDecodedBody encodes data with the named Content-Transfer-Encoding and
+// stores it in Body, updating the Content-Transfer-Encoding header to match.
+// Since 7bit is the default encoding, the header is not added for 7bit
+// content if m does not already have one.
+func (m *MessagePart) SetDecodedBody(data []byte, encoding string) error {
+	encoding = strings.ToLower(encoding)
+	switch encoding {
+	case Encoding7Bit:
+		if !is7Bit(data) {
+			return errors.New("cannot use 7bit encoding for content with 8bit characters")
+		}
+		m.Body = string(data)
+	case Encoding8Bit, EncodingBinary:
+		m.Body = string(data)
+	case EncodingQuotedPrintable:
+		b := new(bytes.Buffer)
+		w := quotedprintable.NewWriter(b)
+		w.Write(data)
+		w.Close()
+		m.Body = b.String()
+	case EncodingBase64:
+		m.Body = encodeBase64Lines(data)
+	default:
+		return errors.New("unsupported content transfer encoding: " + encoding)
+	}
+	if encoding != Encoding7Bit || m.findFirstHeader(cteHeader) != nil {
+		m.SetHeader(cteHeader, encoding)
+	}
+	return nil
+}
+
+// replaceDecodedBody sets the content of p to data while keeping the
+// existing transfer encoding of p where possible.
+func replaceDecodedBody(p *MessagePart, data []byte) error {
+	cte := p.TransferEncoding()
+	if cte == Encoding7Bit && !is7Bit(data) {
+		cte = Encoding8Bit
+	}
+	return p.SetDecodedBody(data, cte)
+}
+
+func encodeBase64Lines(data []byte) string {
+	enc := base64.StdEncoding.EncodeToString(data)
+	b := new(bytes.Buffer)
+	for len(enc) > base64LineLength {
+		b.WriteString(enc[:base64LineLength])
+		b.Write(crlf)
+		enc = enc[base64LineLength:]
+	}
+	b.WriteString(enc)
+	b.Write(crlf)
+	return b.String()
+}
+
+func stripWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func is7Bit(data []byte) bool {
+	for _, c := range data {
+		if c >= 0x80 || c == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package pgpmail
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestDecodedBody(t *testing.T) {
+	p := new(MessagePart)
+	p.AddHeader(cteHeader, "Quoted-Printable")
+	p.Body = "caf=C3=A9 with a soft=\r\nbreak\r\n"
+	data, err := p.DecodedBody()
+	if err != nil {
+		t.Fatal("error decoding quoted-printable body: " + err.Error())
+	}
+	if string(data) != "café with a softbreak\r\n" {
+		t.Errorf("quoted-printable body decoded incorrectly: %q", data)
+	}
+
+	p.SetHeader(cteHeader, "base64")
+	p.Body = "VGhpcyBpcyBh\r\nIHRlc3Qu\r\n"
+	data, err = p.DecodedBody()
+	if err != nil {
+		t.Fatal("error decoding base64 body: " + err.Error())
+	}
+	if string(data) != "This is a test." {
+		t.Errorf("base64 body decoded incorrectly: %q", data)
+	}
+
+	p.SetHeader(cteHeader, "x-uuencode")
+	if _, err := p.DecodedBody(); err == nil {
+		t.Error("expecting error for unsupported transfer encoding")
+	}
+}
+
+func TestSetDecodedBody(t *testing.T) {
+	data := []byte(strings.Repeat("Long line of text with an ümlaut. ", 10) + "\r\n")
+	for _, enc := range []string{Encoding8Bit, EncodingQuotedPrintable, EncodingBase64} {
+		p := new(MessagePart)
+		if err := p.SetDecodedBody(data, enc); err != nil {
+			t.Fatalf("error setting body with %s encoding: %v", enc, err)
+		}
+		if p.GetHeaderValue(cteHeader) != enc {
+			t.Errorf("transfer encoding header not set to %s", enc)
+		}
+		for _, line := range strings.Split(p.Body, "\r\n") {
+			if enc != Encoding8Bit && len(line) > 76 {
+				t.Errorf("%s encoded line exceeds 76 characters", enc)
+			}
+		}
+		decoded, err := p.DecodedBody()
+		if err != nil {
+			t.Fatalf("error decoding %s body: %v", enc, err)
+		}
+		if string(decoded) != string(data) {
+			t.Errorf("%s body did not round trip: %q", enc, decoded)
+		}
+	}
+
+	p := new(MessagePart)
+	if err := p.SetDecodedBody(data, Encoding7Bit); err == nil {
+		t.Error("expecting error setting 8bit content with 7bit encoding")
+	}
+	if err := p.SetDecodedBody([]byte("ascii"), Encoding7Bit); err != nil {
+		t.Error("unexpected error setting 7bit content: " + err.Error())
+	}
+	if p.findFirstHeader(cteHeader) != nil {
+		t.Error("7bit transfer encoding header should not be added")
+	}
+}
+
+func TestInlineDecryptBase64(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(insertCR(testInlineCiphertext)))
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{"Content-Type: text/plain; charset=UTF-8\nContent-Transfer-Encoding: base64\n\n" + encoded}
+	m := td.Message()
+
+	status := m.Decrypt(testKeys)
+	if status.Code != DecryptSuccess {
+		t.Fatal("Base64 encoded inline message did not decrypt successfully")
+	}
+	p := m.Parts()[0]
+	if p.TransferEncoding() != EncodingBase64 {
+		t.Error("Transfer encoding of decrypted part was not preserved")
+	}
+	data, _ := p.DecodedBody()
+	if string(data) != "This is a test inline message.\r\n\r\n" {
+		t.Errorf("Decrypted base64 part does not match expected message: %q", data)
+	}
+}
+
+func TestClearSignQuotedPrintable(t *testing.T) {
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{"Content-Type: text/plain\nContent-Transfer-Encoding: quoted-printable\n\n" +
+		strings.Replace(clearsignData, "PGP SIGNED MESSAGE", "PGP SIGNED =\nMESSAGE", 1)}
+	m := td.Message()
+
+	status := m.Verify(testKeys)
+	if status.Code != VerifySigValid {
+		t.Fatalf("Quoted-printable clearsigned part did not verify: %v", status.Code)
+	}
+	data, _ := m.Parts()[0].DecodedBody()
+	if strings.TrimSpace(string(data)) != "This is a clearsign test message." {
+		t.Errorf("Verified part does not contain signed plaintext: %q", data)
+	}
+}
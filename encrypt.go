@@ -4,11 +4,11 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"net/mail"
 	"time"
 
 	"code.google.com/p/go.crypto/openpgp"
 	"code.google.com/p/go.crypto/openpgp/armor"
+	"code.google.com/p/go.crypto/openpgp/packet"
 )
 
 const (
@@ -27,14 +27,25 @@ type EncryptStatus struct {
 	MissingKeys    []string
 	FailureMessage string
 	Message        *Message
+	// UnusableKeys lists the keys found for recipients which were not used
+	// because they cannot be encrypted to
+	UnusableKeys []UnusableKey
+}
+
+// An UnusableKey is a public key found for a recipient address which
+// cannot be encrypted to, such as a revoked or expired key.
+type UnusableKey struct {
+	Address string
+	KeyId   uint64
+	Reason  string
 }
 
 func (m *Message) Encrypt(keysrc KeySource) *EncryptStatus {
-	return encryptMessage(m, keysrc, false, "")
+	return encryptMessage(m, keysrc, false, "", DefaultOptions())
 }
 
 func (m *Message) EncryptAndSign(keysrc KeySource, passphrase string) *EncryptStatus {
-	return encryptMessage(m, keysrc, true, passphrase)
+	return encryptMessage(m, keysrc, true, passphrase, DefaultOptions())
 }
 
 func createEncryptFailure(msg string) *EncryptStatus {
@@ -44,28 +55,40 @@ func createEncryptFailure(msg string) *EncryptStatus {
 	return status
 }
 
-func encryptMessage(m *Message, keysrc KeySource, sign bool, passphrase string) *EncryptStatus {
-	as := getRecipientAddresses(m)
+func encryptMessage(m *Message, keysrc KeySource, sign bool, passphrase string, opts *Options) *EncryptStatus {
+	as := getRecipientAddresses(m, opts)
 	if len(as) == 0 {
 		return createEncryptFailure("cannot encrypt message, no recipients")
 	}
-	pubkeys, err := getRecipientKeys(keysrc, as)
+	pubkeys, unusable, err := getRecipientKeys(keysrc, as, opts.EncryptToAllKeys, opts.Config.Now())
 	if err != nil {
+		if e, ok := err.(PublicKeysNeededError); ok {
+			return &EncryptStatus{
+				Code:           StatusFailedNeedPubkeys,
+				MissingKeys:    e.Addresses,
+				FailureMessage: err.Error(),
+				UnusableKeys:   unusable,
+			}
+		}
 		return createEncryptFailure(err.Error())
 	}
+	var st *EncryptStatus
 	if sign {
-		return encryptAndSignMessage(m, pubkeys, keysrc, passphrase)
+		st = encryptAndSignMessage(m, pubkeys, keysrc, passphrase, opts)
+	} else {
+		st = encryptWith(m, pubkeys, nil, "", opts.Config)
 	}
-	return encryptWith(m, pubkeys, nil, "")
+	st.UnusableKeys = unusable
+	return st
 }
 
-func encryptAndSignMessage(m *Message, pubkeys openpgp.EntityList, keysrc KeySource, passphrase string) *EncryptStatus {
-	if !useCombinedSignatures {
-		st := m.Sign(keysrc, passphrase)
+func encryptAndSignMessage(m *Message, pubkeys openpgp.EntityList, keysrc KeySource, passphrase string, opts *Options) *EncryptStatus {
+	if !opts.UseCombinedSignatures {
+		st := signWith(m, keysrc, passphrase, opts.Config)
 		if st.Code != StatusSignedOnly {
 			return st
 		}
-		st = encryptWith(m, pubkeys, nil, "")
+		st = encryptWith(m, pubkeys, nil, "", opts.Config)
 		if st.Code == StatusEncryptedOnly {
 			st.Code = StatusSignedAndEncrypted
 		}
@@ -78,36 +101,111 @@ func encryptAndSignMessage(m *Message, pubkeys openpgp.EntityList, keysrc KeySou
 		}
 		return createEncryptFailure(err.Error())
 	}
-	return encryptWith(m, pubkeys, signingKey, passphrase)
+	return encryptWith(m, pubkeys, signingKey, passphrase, opts.Config)
 }
 
-func getRecipientKeys(keysrc KeySource, addresses []string) ([]*openpgp.Entity, error) {
+// getRecipientKeys returns the best key which can be encrypted to for each
+// address, or every such key if all is true, along with the keys found
+// which cannot be used.  A key found for several addresses is returned
+// once.
+func getRecipientKeys(keysrc KeySource, addresses []string, all bool, now time.Time) ([]*openpgp.Entity, []UnusableKey, error) {
 	var missing []string
+	var unusable []UnusableKey
 	pubkeys := []*openpgp.Entity{}
+	seen := make(map[[20]byte]bool)
+	add := func(k *openpgp.Entity) {
+		if !seen[k.PrimaryKey.Fingerprint] {
+			seen[k.PrimaryKey.Fingerprint] = true
+			pubkeys = append(pubkeys, k)
+		}
+	}
 	for _, a := range addresses {
-		k, err := keysrc.GetPublicKey(a)
+		ks, err := keysrc.GetAllPublicKeys(a)
 		if err != nil {
-			return nil, errors.New("error looking up recipient key '" + a + "': " + err.Error())
+			return nil, nil, errors.New("error looking up recipient key '" + a + "': " + err.Error())
 		}
-		if k == nil {
+		var best *openpgp.Entity
+		var bestTime time.Time
+		for _, k := range ks {
+			t, reason := encryptionKeyProblem(k, now)
+			if reason != "" {
+				unusable = append(unusable, UnusableKey{a, k.PrimaryKey.KeyId, reason})
+				continue
+			}
+			if all {
+				add(k)
+			}
+			if best == nil || t.After(bestTime) {
+				best, bestTime = k, t
+			}
+		}
+		if best == nil {
 			missing = append(missing, a)
-		} else {
-			pubkeys = append(pubkeys, k)
+		} else if !all {
+			add(best)
 		}
 	}
 	if len(missing) > 0 {
-		return nil, PublicKeysNeededError{missing}
+		return nil, unusable, PublicKeysNeededError{missing}
+	}
+	return pubkeys, unusable, nil
+}
+
+// encryptionKeyProblem returns the reason e cannot be encrypted to, or an
+// empty string and the creation time of the key which would be used.  A
+// key with a newer encryption key is preferred when an address has
+// several.
+func encryptionKeyProblem(e *openpgp.Entity, now time.Time) (time.Time, string) {
+	if len(e.Revocations) > 0 {
+		return time.Time{}, "key is revoked"
+	}
+	id := primaryIdentity(e)
+	if id == nil || id.SelfSignature == nil {
+		return time.Time{}, "key has no valid identity"
+	}
+	if id.SelfSignature.KeyExpired(now) {
+		return time.Time{}, "key has expired"
+	}
+	var newest time.Time
+	found, expired := false, false
+	for _, sk := range e.Subkeys {
+		if sk.Sig == nil || sk.Sig.SigType == packet.SigTypeSubkeyRevocation {
+			continue
+		}
+		if !sk.Sig.FlagsValid || !sk.Sig.FlagEncryptCommunications || !sk.PublicKey.PubKeyAlgo.CanEncrypt() {
+			continue
+		}
+		if sk.Sig.KeyExpired(now) {
+			expired = true
+			continue
+		}
+		if !found || sk.Sig.CreationTime.After(newest) {
+			newest = sk.Sig.CreationTime
+		}
+		found = true
+	}
+	if found {
+		return newest, ""
+	}
+	// As in the openpgp package the primary key is used if it has no usage
+	// flags or is marked for encryption
+	sig := id.SelfSignature
+	if (!sig.FlagsValid || sig.FlagEncryptCommunications) && e.PrimaryKey.PubKeyAlgo.CanEncrypt() {
+		return sig.CreationTime, ""
+	}
+	if expired {
+		return time.Time{}, "encryption subkey has expired"
 	}
-	return pubkeys, nil
+	return time.Time{}, "key has no encryption key"
 }
 
 var recipientHeaders = []string{"To", "Cc", "Bcc"}
 
-func getRecipientAddresses(m *Message) []string {
+func getRecipientAddresses(m *Message, opts *Options) []string {
 	as := []string{}
 	for _, hName := range recipientHeaders {
 		for _, hVal := range m.GetHeaders(hName) {
-			addrs, err := mail.ParseAddressList(hVal)
+			addrs, err := addressParser.ParseList(hVal)
 			if err == nil {
 				for _, addr := range addrs {
 					as = append(as, addr.Address)
@@ -115,7 +213,7 @@ func getRecipientAddresses(m *Message) []string {
 			}
 		}
 	}
-	if encryptToSelf {
+	if opts.EncryptToSelf {
 		self := getSenderAddress(m)
 		if self == "" {
 			logger.Warning("Was unable to determine sender address while compiling recipient key list")
@@ -126,7 +224,7 @@ func getRecipientAddresses(m *Message) []string {
 	return as
 }
 
-func encryptWith(m *Message, pubkeys openpgp.EntityList, signingEntity *openpgp.Entity, passphrase string) *EncryptStatus {
+func encryptWith(m *Message, pubkeys openpgp.EntityList, signingEntity *openpgp.Entity, passphrase string, config *packet.Config) *EncryptStatus {
 	if len(pubkeys) == 0 {
 		return createEncryptFailure("no recipient keys")
 	}
@@ -135,13 +233,13 @@ func encryptWith(m *Message, pubkeys openpgp.EntityList, signingEntity *openpgp.
 	if err != nil {
 		return createEncryptFailure("error encoding output message: " + err.Error())
 	}
-	if signingEntity.PrivateKey == nil {
+	if signingEntity != nil && signingEntity.PrivateKey == nil {
 		return createEncryptFailure("signing key has no private key")
 	}
-	if signingEntity != nil && isSigningKeyLocked(signingEntity, passphrase) {
+	if signingEntity != nil && isSigningKeyLocked(signingEntity, passphrase, config) {
 		return &EncryptStatus{Code: StatusFailedPassphraseNeeded}
 	}
-	w, err := openpgp.Encrypt(ar, pubkeys, signingEntity, nil, openpgpConfig)
+	w, err := openpgp.Encrypt(ar, pubkeys, signingEntity, nil, config)
 	if err != nil {
 		return createEncryptFailure("encryption operation failed: " + err.Error())
 	}
@@ -161,8 +259,8 @@ func encryptWith(m *Message, pubkeys openpgp.EntityList, signingEntity *openpgp.
 	}
 }
 
-func isSigningKeyLocked(e *openpgp.Entity, passphrase string) bool {
-	sk, ok := signingKey(e, openpgpConfig.Now())
+func isSigningKeyLocked(e *openpgp.Entity, passphrase string, config *packet.Config) bool {
+	sk, ok := signingKey(e, config.Now())
 	// if !ok then openpgp.Encrypt() is going to fail and return the right error
 	if !ok || !sk.PrivateKey.Encrypted {
 		return false
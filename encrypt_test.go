@@ -1,9 +1,16 @@
 package pgpmail
 
-import "testing"
+import (
+	"crypto"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
 
 func TestEncrypt(t *testing.T) {
-	encryptToSelf = false
+	SetEncryptToSelf(false)
 	msg := "This is a test message.\n"
 	tdata := new(TestData)
 	tdata.To = "user1@example.com"
@@ -51,11 +58,112 @@ func TestDecryptNotEncrypted(t *testing.T) {
 	}
 }
 
+func TestEncryptKeySelection(t *testing.T) {
+	pub, _ := loadTestKeyring()
+	k := firstKeyByEmail("user1@example.com", pub)
+
+	expired := copyEntity(k)
+	for _, id := range expired.Identities {
+		sig := *id.SelfSignature
+		lifetime := uint32(1)
+		sig.KeyLifetimeSecs = &lifetime
+		id.SelfSignature = &sig
+	}
+	revoked := copyEntity(k)
+	revoked.Revocations = append(revoked.Revocations, &packet.Signature{SigType: packet.SigTypeKeyRevocation})
+	signOnly := copyEntity(k)
+	signOnly.Subkeys = nil
+	for _, id := range signOnly.Identities {
+		sig := *id.SelfSignature
+		sig.FlagsValid, sig.FlagSign, sig.FlagEncryptCommunications = true, true, false
+		id.SelfSignature = &sig
+	}
+
+	opts := DefaultOptions()
+	opts.EncryptToSelf = false
+	opts.Config = &packet.Config{}
+	p := NewProcessor(opts)
+	encrypt := func(keys ...*openpgp.Entity) *EncryptStatus {
+		td := new(TestData)
+		td.To = "user1@example.com"
+		td.Body = "Hello, World"
+		return p.Encrypt(td.Message(), &testKeySource{pubkeys: keys})
+	}
+
+	st := encrypt(expired, k)
+	if st.Code != StatusEncryptedOnly {
+		t.Fatalf("expecting valid key to be used, got status %d: %s", st.Code, st.FailureMessage)
+	}
+	if len(st.UnusableKeys) != 1 || st.UnusableKeys[0].Reason != "key has expired" || st.UnusableKeys[0].Address != "user1@example.com" {
+		t.Errorf("expecting expired key to be reported, got %v", st.UnusableKeys)
+	}
+
+	for _, tt := range []struct {
+		key    *openpgp.Entity
+		reason string
+	}{
+		{revoked, "key is revoked"},
+		{signOnly, "key has no encryption key"},
+	} {
+		st := encrypt(tt.key)
+		if st.Code != StatusFailedNeedPubkeys || len(st.MissingKeys) != 1 {
+			t.Errorf("expecting missing key for %s, got status %d", tt.reason, st.Code)
+		}
+		if len(st.UnusableKeys) != 1 || st.UnusableKeys[0].Reason != tt.reason {
+			t.Errorf("expecting unusable key reason %q, got %v", tt.reason, st.UnusableKeys)
+		}
+	}
+}
+
+func TestEncryptToAllKeys(t *testing.T) {
+	pub, sec := loadTestKeyring()
+	oldPub := firstKeyByEmail("user1@example.com", pub)
+	oldSec := firstKeyByEmail("user1@example.com", sec)
+	newKey, err := openpgp.NewEntity("Test User 1", "", "user1@example.com", &packet.Config{DefaultHash: crypto.SHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &testKeySource{pubkeys: openpgp.EntityList{oldPub, newKey}}
+
+	encrypt := func(all bool) string {
+		opts := DefaultOptions()
+		opts.EncryptToSelf = false
+		opts.EncryptToAllKeys = all
+		opts.Config = &packet.Config{}
+		td := new(TestData)
+		td.To = "user1@example.com"
+		td.Body = "Hello, World"
+		m := td.Message()
+		if st := NewProcessor(opts).Encrypt(m, keys); st.Code != StatusEncryptedOnly {
+			t.Fatalf("error encrypting message: %s", st.FailureMessage)
+		}
+		return m.String()
+	}
+	decrypts := func(msg string, k *openpgp.Entity) bool {
+		m, err := ParseMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.Decrypt(&testKeySource{seckeys: openpgp.EntityList{k}}).Code == DecryptSuccess
+	}
+
+	msg := encrypt(false)
+	if !decrypts(msg, newKey) || decrypts(msg, oldSec) {
+		t.Error("expecting message encrypted only to newest key")
+	}
+	msg = encrypt(true)
+	if !decrypts(msg, newKey) || !decrypts(msg, oldSec) {
+		t.Error("expecting message encrypted to every key of recipient")
+	}
+}
+
 var expectedEncryptedMessage = insertCR(`From: from@example.com
 To: user1@example.com
 Subject: Test Encrypted Message
 Mime-Version: 1.0
-Content-Type: multipart/encrypted; boundary=0c74507f56a92b4be35f4f8b18640f3b2e099f7cc8953151ef58abffe70c; protocol="application/pgp-encrypted"
+Content-Type: multipart/encrypted;
+ boundary=0c74507f56a92b4be35f4f8b18640f3b2e099f7cc8953151ef58abffe70c;
+ protocol="application/pgp-encrypted"
 
 This is an OpenPGP/MIME encrypted message (RFC 4880 and 3156)
 
@@ -97,3 +205,79 @@ ZoWyrrOdnU6wrrqsojU0oosS50CHez2DXJR14E02IBM4dDY2s9RQ8CVr
 -----END PGP MESSAGE-----
 
 blah blah`
+
+func TestInlineDecryptNested(t *testing.T) {
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{
+		`Content-Type: multipart/alternative; boundary=nested0123
+
+--nested0123
+Content-Type: text/plain; charset=UTF-8
+` + testInlineCiphertext + `
+--nested0123--`,
+		attachmentPart,
+	}
+	m := td.Message()
+
+	status := m.Decrypt(testKeys)
+	if status.Code != DecryptSuccess {
+		t.Fatal("Nested inline encrypted part did not decrypt successfully")
+	}
+	const inlinePlaintext = "This is a test inline message.\r\n\r\n"
+	if body := m.Parts()[0].Parts()[0].Body; body != inlinePlaintext {
+		t.Errorf("Decrypted nested part does not match expected plaintext: %q", body)
+	}
+	m2, _ := ParseMessage(m.String())
+	if body := m2.Parts()[0].Parts()[0].Body; body != inlinePlaintext {
+		t.Error("Decrypted nested part was not packed into message body")
+	}
+}
+
+func TestInlineDecryptLF(t *testing.T) {
+	td := new(TestData)
+	td.Body = testInlineCiphertext
+	m, err := ParseMessage(strings.Replace(td.String(), "\r\n", "\n", -1))
+	if err != nil {
+		t.Fatal("error parsing LF message: " + err.Error())
+	}
+	if status := m.Decrypt(testKeys); status.Code != DecryptSuccess {
+		t.Fatal("LF inline encrypted message did not decrypt successfully")
+	}
+	if m.Body != "This is a test inline message.\n\n" {
+		t.Errorf("Decrypted LF message does not have LF line endings: %q", m.Body)
+	}
+}
+
+func TestDecryptEmbedded(t *testing.T) {
+	SetProcessEmbeddedMessages(true)
+	defer SetProcessEmbeddedMessages(false)
+
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{plainPart, "Content-Type: message/rfc822\r\n\r\n" +
+		"From: alice@example.com\r\nSubject: Forwarded\r\n\r\n" + testInlineCiphertext}
+	m := td.Message()
+
+	status := m.Decrypt(testKeys)
+	if status.Code != DecryptNotEncrypted {
+		t.Errorf("Expecting outer message to be DecryptNotEncrypted, got %d", status.Code)
+	}
+	if len(status.Embedded) != 1 || status.Embedded[0].Code != DecryptSuccess {
+		t.Fatalf("Embedded message did not decrypt successfully: %v", status.Embedded)
+	}
+	em, err := m.Parts()[1].EmbeddedMessage()
+	if err != nil {
+		t.Fatal("error parsing embedded message: " + err.Error())
+	}
+	if em.GetHeaderValue("Subject") != "Forwarded" {
+		t.Errorf("unexpected embedded message subject: %q", em.GetHeaderValue("Subject"))
+	}
+	const inlinePlaintext = "This is a test inline message.\r\n\r\n"
+	if em.Body != inlinePlaintext {
+		t.Errorf("Decrypted embedded message does not match expected plaintext: %q", em.Body)
+	}
+	if !strings.Contains(m.String(), "Subject: Forwarded\r\n\r\n"+inlinePlaintext) {
+		t.Error("Decrypted embedded message was not packed into message body")
+	}
+}
@@ -0,0 +1,556 @@
+package pgpmail
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/armor"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// FileKeyRing is a KeySource backed by a public and a secret keyring file.
+// The files may be armored or binary and are saved in the format they were
+// loaded in.  Changes made through the FileKeyRing are written to disk
+// immediately by replacing the files atomically, and the files are loaded
+// again when they are changed by another program.  A FileKeyRing is safe
+// for concurrent use.  A FileKeyRing created without NewFileKeyRing loads
+// the files when it is first used.
+type FileKeyRing struct {
+	// PublicPath and SecretPath are the keyring files.  SecretPath may be
+	// empty if there are no secret keys.
+	PublicPath string
+	SecretPath string
+
+	mu      sync.RWMutex
+	keys    *KeyRing
+	norm    *AddressNormalization
+	pubFile keyringFile
+	secFile keyringFile
+	// loadErr is the error from the last attempt to load the files, which
+	// are not read again until they change
+	loadErr error
+	// rawSecret holds the secret key packets read from SecretPath or
+	// imported by key fingerprint, since encrypted private keys cannot be
+	// serialized again
+	rawSecret map[[20]byte][]byte
+}
+
+// keyringFile records the state of a keyring file when it was last read
+// or written.
+type keyringFile struct {
+	modTime time.Time
+	size    int64
+	armored bool
+}
+
+// NewFileKeyRing loads the keyring files at pubPath and secPath.  Files
+// which do not exist are treated as empty and are created when keys are
+// added.
+func NewFileKeyRing(pubPath, secPath string) (*FileKeyRing, error) {
+	fk := &FileKeyRing{PublicPath: pubPath, SecretPath: secPath}
+	if err := fk.Reload(); err != nil {
+		return nil, err
+	}
+	return fk, nil
+}
+
+// Reload reads both keyring files, discarding the keys held in memory.
+func (fk *FileKeyRing) Reload() error {
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	return fk.load()
+}
+
+// load reads both keyring files.  If they cannot be read the keys held in
+// memory are kept and the state of the files is recorded, so that they are
+// not read again until they change.
+func (fk *FileKeyRing) load() error {
+	err := fk.readFiles()
+	fk.loadErr = err
+	if err != nil {
+		fk.pubFile.record(fk.PublicPath)
+		if fk.SecretPath != "" {
+			fk.secFile.record(fk.SecretPath)
+		}
+		if fk.keys == nil {
+			fk.keys = fk.newKeyRing()
+		}
+	}
+	return err
+}
+
+func (fk *FileKeyRing) newKeyRing() *KeyRing {
+	kr := new(KeyRing)
+	if fk.norm != nil {
+		kr.SetAddressNormalization(*fk.norm)
+	}
+	return kr
+}
+
+func (fk *FileKeyRing) readFiles() error {
+	kr := fk.newKeyRing()
+	pub, pubFile, _, err := readKeyringFile(fk.PublicPath)
+	if err != nil {
+		return errors.New("error reading public keyring: " + err.Error())
+	}
+	for _, e := range pub {
+		kr.AddPublicKey(e)
+	}
+	var secFile keyringFile
+	var rawSecret map[[20]byte][]byte
+	if fk.SecretPath != "" {
+		var sec openpgp.EntityList
+		sec, secFile, rawSecret, err = readKeyringFile(fk.SecretPath)
+		if err != nil {
+			return errors.New("error reading secret keyring: " + err.Error())
+		}
+		for _, e := range sec {
+			kr.AddSecretKey(e)
+		}
+	}
+	fk.keys, fk.pubFile, fk.secFile, fk.rawSecret = kr, pubFile, secFile, rawSecret
+	return nil
+}
+
+// SetAddressNormalization changes how addresses are compared when keys are
+// looked up by email address, as for KeyRing.SetAddressNormalization.
+func (fk *FileKeyRing) SetAddressNormalization(an AddressNormalization) {
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	fk.norm = &an
+	if fk.keys != nil {
+		fk.keys.SetAddressNormalization(an)
+	}
+}
+
+// current returns the keys, first loading the files again if either has
+// changed since it was last read or written.
+func (fk *FileKeyRing) current() *KeyRing {
+	fk.mu.RLock()
+	kr, stale := fk.keys, fk.stale()
+	fk.mu.RUnlock()
+	if !stale {
+		return kr
+	}
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	fk.refresh()
+	return fk.keys
+}
+
+// refresh loads the files if they have not been loaded or have changed,
+// which another caller may already have done while the lock was released.
+// It must be called with the write lock held.
+func (fk *FileKeyRing) refresh() {
+	if fk.stale() {
+		if err := fk.load(); err != nil {
+			logger.Warning("error reloading keyring: " + err.Error())
+		}
+	}
+}
+
+func (fk *FileKeyRing) stale() bool {
+	return fk.keys == nil || fk.pubFile.changed(fk.PublicPath) ||
+		(fk.SecretPath != "" && fk.secFile.changed(fk.SecretPath))
+}
+
+func (f *keyringFile) changed(path string) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return !f.modTime.IsZero()
+	}
+	return !fi.ModTime().Equal(f.modTime) || fi.Size() != f.size
+}
+
+// record notes the current state of the file at path without reading it.
+func (f *keyringFile) record(path string) {
+	f.modTime, f.size = time.Time{}, 0
+	if fi, err := os.Stat(path); err == nil {
+		f.modTime, f.size = fi.ModTime(), fi.Size()
+	}
+}
+
+func (fk *FileKeyRing) GetPublicKeyRing() openpgp.EntityList {
+	return fk.current().GetPublicKeyRing()
+}
+
+func (fk *FileKeyRing) GetPublicKey(address string) (*openpgp.Entity, error) {
+	return fk.current().GetPublicKey(address)
+}
+
+func (fk *FileKeyRing) GetAllPublicKeys(address string) (openpgp.EntityList, error) {
+	return fk.current().GetAllPublicKeys(address)
+}
+
+func (fk *FileKeyRing) GetPublicKeyById(keyid uint64) *openpgp.Entity {
+	return fk.current().GetPublicKeyById(keyid)
+}
+
+func (fk *FileKeyRing) GetSecretKeyRing() openpgp.EntityList {
+	return fk.current().GetSecretKeyRing()
+}
+
+func (fk *FileKeyRing) GetSecretKey(address string) (*openpgp.Entity, error) {
+	return fk.current().GetSecretKey(address)
+}
+
+func (fk *FileKeyRing) GetAllSecretKeys(address string) (openpgp.EntityList, error) {
+	return fk.current().GetAllSecretKeys(address)
+}
+
+func (fk *FileKeyRing) GetSecretKeyById(keyid uint64) *openpgp.Entity {
+	return fk.current().GetSecretKeyById(keyid)
+}
+
+// AddPublicKey adds or merges k as for KeyRing.AddPublicKey and saves the
+// public keyring.
+func (fk *FileKeyRing) AddPublicKey(k *openpgp.Entity) error {
+	return fk.update(false, func(kr *KeyRing) { kr.AddPublicKey(k) })
+}
+
+// AddSecretKey adds or merges k as for KeyRing.AddSecretKey and saves the
+// secret keyring.  The openpgp package cannot serialize private keys which
+// are still encrypted, so keys protected with a passphrase must be added
+// with ImportSecretKeys unless the keyring already holds them.
+func (fk *FileKeyRing) AddSecretKey(k *openpgp.Entity) error {
+	if fk.SecretPath == "" {
+		return errors.New("no secret keyring file")
+	}
+	return fk.update(true, func(kr *KeyRing) { kr.AddSecretKey(k) })
+}
+
+// ImportSecretKeys reads the armored or binary secret keys in r and adds
+// them as for AddSecretKey.  The secret key packets are saved as they were
+// read, so encrypted private keys stay encrypted.
+func (fk *FileKeyRing) ImportSecretKeys(r io.Reader) error {
+	if fk.SecretPath == "" {
+		return errors.New("no secret keyring file")
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	es, _, raw, err := readKeyringData(data)
+	if err != nil {
+		return errors.New("error reading secret keys: " + err.Error())
+	}
+	return fk.update(true, func(kr *KeyRing) {
+		if fk.rawSecret == nil {
+			fk.rawSecret = make(map[[20]byte][]byte)
+		}
+		for fp, p := range raw {
+			fk.rawSecret[fp] = p
+		}
+		for _, e := range es {
+			kr.AddSecretKey(e)
+		}
+	})
+}
+
+// Replace replaces k as for KeyRing.Replace and saves the keyrings.  The
+// saved secret key packets of the keys of k are kept for private keys which
+// are still encrypted and discarded for the others, so that they are written
+// as given.
+func (fk *FileKeyRing) Replace(k *openpgp.Entity) error {
+	secret := k.PrivateKey != nil
+	if secret && fk.SecretPath == "" {
+		return errors.New("no secret keyring file")
+	}
+	return fk.update(secret, func(kr *KeyRing) {
+		kr.Replace(k)
+		if secret {
+			fk.forgetRawSecret(k)
+		}
+	})
+}
+
+// Remove removes the keys with the given primary key fingerprint as for
+// KeyRing.Remove and saves the keyrings.
+func (fk *FileKeyRing) Remove(fingerprint [20]byte) (bool, error) {
+	removed := false
+	err := fk.update(fk.SecretPath != "", func(kr *KeyRing) { removed = kr.Remove(fingerprint) })
+	return removed, err
+}
+
+// update applies fn to the keys and saves the public keyring, and the
+// secret keyring if secret is true.  The files are loaded first if they
+// have changed, and nothing is saved if they cannot be read, so that
+// changes made by another program are not lost.  If saving fails the files
+// are loaded again so that the keys in memory match the files.
+func (fk *FileKeyRing) update(secret bool, fn func(kr *KeyRing)) error {
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	fk.refresh()
+	if fk.loadErr != nil {
+		return errors.New("keyring not saved: " + fk.loadErr.Error())
+	}
+	kr := fk.keys
+	fn(kr)
+	err := fk.save(fk.PublicPath, &fk.pubFile, kr.GetPublicKeyRing(), false)
+	if err == nil && secret {
+		err = fk.save(fk.SecretPath, &fk.secFile, kr.GetSecretKeyRing(), true)
+	}
+	if err != nil {
+		if lerr := fk.load(); lerr != nil {
+			logger.Warning("error reloading keyring: " + lerr.Error())
+		}
+		return errors.New("error saving keyring: " + err.Error())
+	}
+	return nil
+}
+
+func (fk *FileKeyRing) forgetRawSecret(k *openpgp.Entity) {
+	forget := func(pk *packet.PrivateKey) {
+		if pk != nil && !pk.Encrypted {
+			delete(fk.rawSecret, pk.PublicKey.Fingerprint)
+		}
+	}
+	forget(k.PrivateKey)
+	for _, sk := range k.Subkeys {
+		forget(sk.PrivateKey)
+	}
+}
+
+// save writes es to a temporary file beside path and renames it over
+// path, then records the state of the new file in f.
+func (fk *FileKeyRing) save(path string, f *keyringFile, es openpgp.EntityList, secret bool) error {
+	buf := new(bytes.Buffer)
+	var w io.Writer = buf
+	var aw io.WriteCloser
+	if f.armored {
+		blockType := openpgp.PublicKeyType
+		if secret {
+			blockType = openpgp.PrivateKeyType
+		}
+		var err error
+		if aw, err = armor.Encode(buf, blockType, nil); err != nil {
+			return err
+		}
+		w = aw
+	}
+	for _, e := range es {
+		if err := serializeEntity(w, e, secret, fk.rawSecret); err != nil {
+			return err
+		}
+	}
+	if aw != nil {
+		if err := aw.Close(); err != nil {
+			return err
+		}
+	}
+	mode := os.FileMode(0644)
+	if secret {
+		mode = 0600
+	}
+	if err := writeFileAtomic(path, buf.Bytes(), mode); err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// serializeEntity writes e with its existing signatures.  Unlike
+// Entity.SerializePrivate the identities and subkeys are not signed again,
+// so keys are written unchanged, and identities are written in order of
+// name so that saving the same keys gives the same file.  Secret key
+// packets found in raw are written as they were read, which keeps encrypted
+// private keys encrypted even after they have been unlocked in memory.
+func serializeEntity(w io.Writer, e *openpgp.Entity, secret bool, raw map[[20]byte][]byte) error {
+	if secret {
+		if err := serializePrivateKey(w, e.PrivateKey, raw); err != nil {
+			return err
+		}
+	} else if err := e.PrimaryKey.Serialize(w); err != nil {
+		return err
+	}
+	for _, sig := range e.Revocations {
+		if err := sig.Serialize(w); err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(e.Identities))
+	for name := range e.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		id := e.Identities[name]
+		if err := id.UserId.Serialize(w); err != nil {
+			return err
+		}
+		if id.SelfSignature != nil {
+			if err := id.SelfSignature.Serialize(w); err != nil {
+				return err
+			}
+		}
+		for _, sig := range id.Signatures {
+			if err := sig.Serialize(w); err != nil {
+				return err
+			}
+		}
+	}
+	for _, sk := range e.Subkeys {
+		var err error
+		if secret && sk.PrivateKey != nil {
+			err = serializePrivateKey(w, sk.PrivateKey, raw)
+		} else {
+			err = sk.PublicKey.Serialize(w)
+		}
+		if err != nil {
+			return err
+		}
+		if err := sk.Sig.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serializePrivateKey(w io.Writer, pk *packet.PrivateKey, raw map[[20]byte][]byte) error {
+	if pk == nil {
+		return errors.New("secret key has no private key")
+	}
+	if data, ok := raw[pk.PublicKey.Fingerprint]; ok {
+		_, err := w.Write(data)
+		return err
+	}
+	if pk.Encrypted {
+		return errors.New("cannot serialize encrypted private key, import it with ImportSecretKeys")
+	}
+	return pk.Serialize(w)
+}
+
+// readKeyringFile reads the keys in the armored or binary keyring at path
+// along with the raw secret key packets it contains.  A missing file is
+// read as an empty keyring.
+func readKeyringFile(path string) (openpgp.EntityList, keyringFile, map[[20]byte][]byte, error) {
+	var f keyringFile
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, f, nil, nil
+	} else if err != nil {
+		return nil, f, nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, f, nil, err
+	}
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	es, armored, raw, err := readKeyringData(data)
+	f.armored = armored
+	return es, f, raw, err
+}
+
+// readKeyringData reads the keys and raw secret key packets of an armored
+// or binary keyring.
+func readKeyringData(data []byte) (es openpgp.EntityList, armored bool, raw map[[20]byte][]byte, err error) {
+	if bytes.Contains(data, []byte("-----BEGIN PGP")) {
+		armored = true
+		if data, err = dearmorKeyring(data); err != nil {
+			return nil, armored, nil, err
+		}
+	}
+	if es, err = openpgp.ReadKeyRing(bytes.NewReader(data)); err != nil {
+		return nil, armored, nil, err
+	}
+	if raw, err = rawSecretKeys(data); err != nil {
+		return nil, armored, nil, err
+	}
+	return es, armored, raw, nil
+}
+
+// dearmorKeyring returns the contents of every armored block in data, as
+// written by tools which export each key in its own block.
+func dearmorKeyring(data []byte) ([]byte, error) {
+	out := new(bytes.Buffer)
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		block, err := armor.Decode(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(out, block.Body); err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// rawSecretKeys returns the serialized secret key and subkey packets of a
+// binary keyring by key fingerprint.
+func rawSecretKeys(data []byte) (map[[20]byte][]byte, error) {
+	raw := make(map[[20]byte][]byte)
+	or := packet.NewOpaqueReader(bytes.NewReader(data))
+	for {
+		op, err := or.Next()
+		if err == io.EOF {
+			return raw, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if op.Tag != 5 && op.Tag != 7 {
+			continue
+		}
+		p, err := op.Parse()
+		if err != nil {
+			return nil, err
+		}
+		pk, ok := p.(*packet.PrivateKey)
+		if !ok {
+			continue
+		}
+		buf := new(bytes.Buffer)
+		if err := op.Serialize(buf); err != nil {
+			return nil, err
+		}
+		raw[pk.PublicKey.Fingerprint] = buf.Bytes()
+	}
+}
@@ -0,0 +1,139 @@
+package pgpmail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// addCorpus seeds f with the sample messages in testdata/mime.
+func addCorpus(f *testing.F) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "mime", "*.eml"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, p := range paths {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(data))
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	addCorpus(f)
+	f.Fuzz(func(t *testing.T, msg string) {
+		for _, lenient := range []bool{false, true} {
+			r := NewReader(msg)
+			r.Lenient = lenient
+			m, err := r.ReadMessage()
+			if err != nil {
+				continue
+			}
+			m.Walk(func(path []int, p *MessagePart) error {
+				p.DecodedBody()
+				p.Text()
+				for _, h := range p.HeaderList {
+					h.DecodedValue()
+				}
+				if p.IsEmbeddedMessage() {
+					p.EmbeddedMessage()
+				}
+				return nil
+			})
+			m.Attachments()
+
+			// A rendered message must parse to the same text
+			out := m.String()
+			r2 := NewReader(out)
+			r2.Lenient = lenient
+			m2, err := r2.ReadMessage()
+			if err != nil {
+				t.Fatalf("rendered message does not parse: %v\n%q", err, out)
+			}
+			if m2.String() != out {
+				t.Fatalf("rendered message changed when parsed again:\n%q\n%q", out, m2.String())
+			}
+			if m.mpContent != nil {
+				if err := m.PackMultiparts(); err != nil {
+					t.Fatalf("error packing multiparts: %v", err)
+				}
+				if repacked := m.String(); repacked != out {
+					t.Fatalf("repacked message does not match original:\n%q\n%q", out, repacked)
+				}
+			}
+		}
+	})
+}
+
+func FuzzExtractPart(f *testing.F) {
+	addCorpus(f)
+	f.Fuzz(func(t *testing.T, body string) {
+		for _, boundary := range []string{"outer", "x", "e"} {
+			b := []byte(body)
+			for {
+				n := len(b)
+				_, _, _, last, err := extractPart(&b, []byte("--"+boundary))
+				if err != nil || last {
+					break
+				}
+				if len(b) >= n {
+					t.Fatalf("extractPart did not advance through body %q", body)
+				}
+			}
+		}
+	})
+}
+
+func FuzzReadMIMEHeader(f *testing.F) {
+	addCorpus(f)
+	f.Fuzz(func(t *testing.T, header string) {
+		r := NewReader(header)
+		hs, err := r.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		raw := new(bytes.Buffer)
+		for _, h := range hs {
+			raw.WriteString(h.raw.text)
+		}
+		raw.WriteString(r.headerEnd)
+		if len(header) < raw.Len() || header[:raw.Len()] != raw.String() {
+			t.Fatalf("raw header text %q does not match input %q", raw.String(), header)
+		}
+	})
+}
+
+func FuzzExtractInlineBody(f *testing.F) {
+	addCorpus(f)
+	f.Add(testInlineCiphertext)
+	f.Fuzz(func(t *testing.T, body string) {
+		block, err := extractInlineBody(body)
+		if err != nil || block == nil {
+			return
+		}
+		ioutil.ReadAll(block.Body)
+	})
+}
+
+func FuzzDecryptVerify(f *testing.F) {
+	addCorpus(f)
+	td := new(TestData)
+	td.Body = testInlineCiphertext
+	f.Add(td.String())
+	td.Body = clearsignData
+	f.Add(td.String())
+	opts := DefaultOptions()
+	opts.ProcessEmbeddedMessages = true
+	p := NewProcessor(opts)
+	f.Fuzz(func(t *testing.T, msg string) {
+		if m, err := ParseMessage(msg); err == nil {
+			p.Verify(m, testKeys)
+		}
+		if m, err := ParseMessage(msg); err == nil {
+			p.Decrypt(m, testKeys)
+		}
+	})
+}
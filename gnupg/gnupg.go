@@ -0,0 +1,243 @@
+// Package gnupg provides a read-only pgpmail KeySource for the keys in a
+// GnuPG home directory, so that existing keys can be used without first
+// exporting them.
+//
+// Public keys are read from the pubring.kbx keybox or, for older
+// installations, from pubring.gpg.  Secret keys are read from the key files
+// which gpg-agent keeps in private-keys-v1.d.  Only RSA secret keys are
+// supported.  Keys protected with a passphrase are not available as secret
+// keys until they are unlocked with Unlock.  Public keys which the openpgp
+// package does not support, such as ed25519 keys, and secret keys which are
+// not supported, such as those held on a smartcard, are skipped.
+package gnupg
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+	"github.com/nymsio/pgpmail"
+)
+
+// Home is a KeySource holding the keys of a GnuPG home directory.  The
+// directory is read once by Open.  A Home is safe for concurrent use.
+type Home struct {
+	// Dir is the GnuPG home directory
+	Dir string
+
+	keys pgpmail.KeyRing
+
+	mu sync.Mutex
+	// private holds the private keys read or unlocked so far by
+	// fingerprint
+	private map[[20]byte]*packet.PrivateKey
+	// locked holds the protected private keys by keygrip
+	locked map[string]*lockedKey
+}
+
+// A lockedKey is a protected private key along with the public key it
+// belongs to.
+type lockedKey struct {
+	entity *openpgp.Entity
+	pub    *packet.PublicKey
+	priv   *privateKey
+}
+
+// DefaultDir returns the GnuPG home directory named by GNUPGHOME, or
+// ~/.gnupg if it is not set.
+func DefaultDir() string {
+	if dir := os.Getenv("GNUPGHOME"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), ".gnupg")
+}
+
+// Open reads the public and secret keys of the GnuPG home directory dir.
+// If dir is empty DefaultDir is used.
+func Open(dir string) (*Home, error) {
+	if dir == "" {
+		dir = DefaultDir()
+	}
+	h := &Home{
+		Dir:     dir,
+		private: make(map[[20]byte]*packet.PrivateKey),
+		locked:  make(map[string]*lockedKey),
+	}
+	pub, err := readPublicKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range pub {
+		h.keys.AddPublicKey(e)
+		if err := h.loadPrivateKeys(e); err != nil {
+			return nil, err
+		}
+		h.addSecretKey(e)
+	}
+	return h, nil
+}
+
+// readPublicKeys reads pubring.kbx, or pubring.gpg if there is no keybox.
+func readPublicKeys(dir string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "pubring.kbx"))
+	if err == nil {
+		es, err := readKeybox(data)
+		if err != nil {
+			return nil, errors.New("error reading pubring.kbx: " + err.Error())
+		}
+		return es, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	data, err = ioutil.ReadFile(filepath.Join(dir, "pubring.gpg"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	es, err := readKeyring(data)
+	if err != nil {
+		return nil, errors.New("error reading pubring.gpg: " + err.Error())
+	}
+	return es, nil
+}
+
+// loadPrivateKeys reads the key files for the primary key and subkeys of
+// e.  Unprotected keys are stored in h.private and protected keys in
+// h.locked.  Key files which are not supported are skipped.
+func (h *Home) loadPrivateKeys(e *openpgp.Entity) error {
+	for _, pub := range entityKeys(e) {
+		data, grip, err := h.readKeyFile(pub)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		priv, err := readPrivateKey(data)
+		if _, ok := err.(UnsupportedKeyError); ok {
+			continue
+		} else if err != nil {
+			return errors.New("error reading private key " + grip + ": " + err.Error())
+		}
+		if priv.protected {
+			h.locked[grip] = &lockedKey{entity: e, pub: pub, priv: priv}
+			continue
+		}
+		pk, err := priv.privateKeyPacket(pub, nil)
+		if _, ok := err.(UnsupportedKeyError); ok {
+			continue
+		} else if err != nil {
+			return errors.New("error reading private key " + grip + ": " + err.Error())
+		}
+		h.private[pub.Fingerprint] = pk
+	}
+	return nil
+}
+
+// readKeyFile returns the contents of the key file for pub, or nil if
+// there is none.  Key files are only looked for for RSA keys.
+func (h *Home) readKeyFile(pub *packet.PublicKey) ([]byte, string, error) {
+	keygrip, err := Keygrip(pub)
+	if err != nil {
+		return nil, "", nil
+	}
+	grip := strings.ToUpper(hex.EncodeToString(keygrip))
+	data, err := ioutil.ReadFile(filepath.Join(h.Dir, "private-keys-v1.d", grip+".key"))
+	if os.IsNotExist(err) {
+		return nil, grip, nil
+	}
+	return data, grip, err
+}
+
+// addSecretKey adds a copy of e holding the private keys read for it to
+// the secret keys.  Entities are only added once the private part of the
+// primary key is available.
+func (h *Home) addSecretKey(e *openpgp.Entity) {
+	sec := *e
+	sec.PrivateKey = h.private[e.PrimaryKey.Fingerprint]
+	if sec.PrivateKey == nil {
+		return
+	}
+	sec.Subkeys = append([]openpgp.Subkey{}, e.Subkeys...)
+	for i := range sec.Subkeys {
+		sec.Subkeys[i].PrivateKey = h.private[sec.Subkeys[i].PublicKey.Fingerprint]
+	}
+	// Merging fills in the private keys unlocked since e was last added
+	h.keys.AddSecretKey(&sec)
+}
+
+// Unlock decrypts the protected private keys which use passphrase and
+// adds them to the secret keys.  An error is returned if there were
+// protected keys and none of them could be unlocked.
+func (h *Home) Unlock(passphrase []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.locked) == 0 {
+		return nil
+	}
+	var unlocked []*openpgp.Entity
+	for grip, lk := range h.locked {
+		pk, err := lk.priv.privateKeyPacket(lk.pub, passphrase)
+		if err != nil {
+			continue
+		}
+		h.private[lk.pub.Fingerprint] = pk
+		delete(h.locked, grip)
+		unlocked = append(unlocked, lk.entity)
+	}
+	if len(unlocked) == 0 {
+		return errors.New("no private keys could be unlocked with passphrase")
+	}
+	for _, e := range unlocked {
+		h.addSecretKey(e)
+	}
+	return nil
+}
+
+// entityKeys returns the primary key of e followed by its subkeys.
+func entityKeys(e *openpgp.Entity) []*packet.PublicKey {
+	keys := []*packet.PublicKey{e.PrimaryKey}
+	for _, sk := range e.Subkeys {
+		keys = append(keys, sk.PublicKey)
+	}
+	return keys
+}
+
+func (h *Home) GetPublicKeyRing() openpgp.EntityList {
+	return h.keys.GetPublicKeyRing()
+}
+
+func (h *Home) GetPublicKey(address string) (*openpgp.Entity, error) {
+	return h.keys.GetPublicKey(address)
+}
+
+func (h *Home) GetAllPublicKeys(address string) (openpgp.EntityList, error) {
+	return h.keys.GetAllPublicKeys(address)
+}
+
+func (h *Home) GetPublicKeyById(keyid uint64) *openpgp.Entity {
+	return h.keys.GetPublicKeyById(keyid)
+}
+
+func (h *Home) GetSecretKeyRing() openpgp.EntityList {
+	return h.keys.GetSecretKeyRing()
+}
+
+func (h *Home) GetSecretKey(address string) (*openpgp.Entity, error) {
+	return h.keys.GetSecretKey(address)
+}
+
+func (h *Home) GetAllSecretKeys(address string) (openpgp.EntityList, error) {
+	return h.keys.GetAllSecretKeys(address)
+}
+
+func (h *Home) GetSecretKeyById(keyid uint64) *openpgp.Entity {
+	return h.keys.GetSecretKeyById(keyid)
+}
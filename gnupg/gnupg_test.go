@@ -0,0 +1,269 @@
+package gnupg
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.google.com/p/go.crypto/openpgp"
+)
+
+// The keys in testdata/home were created with GnuPG 2.2.  Each has an RSA
+// primary key and encryption subkey.  The key of locked@example.com is
+// protected with the passphrase "secret" and the key of plain@example.com
+// is not protected.  testdata/legacy holds the same public keys in the
+// pubring.gpg format, including ring trust packets.
+
+func TestOpenKeybox(t *testing.T) {
+	h, err := Open("testdata/home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.GetPublicKeyRing()) != 2 {
+		t.Fatalf("expecting 2 public keys, got %d", len(h.GetPublicKeyRing()))
+	}
+	sk, _ := h.GetSecretKey("plain@example.com")
+	if sk == nil || sk.PrivateKey == nil || sk.Subkeys[0].PrivateKey == nil {
+		t.Fatal("unprotected secret key not loaded")
+	}
+	testDecrypt(t, h, "plain@example.com")
+
+	if sk, _ := h.GetSecretKey("locked@example.com"); sk != nil {
+		t.Error("protected secret key available before unlocking")
+	}
+	if err := h.Unlock([]byte("wrong")); err == nil {
+		t.Error("expecting error unlocking with wrong passphrase")
+	}
+	if err := h.Unlock([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	sk, _ = h.GetSecretKey("locked@example.com")
+	if sk == nil || sk.PrivateKey == nil || sk.Subkeys[0].PrivateKey == nil {
+		t.Fatal("protected secret key not unlocked")
+	}
+	if len(h.GetSecretKeyRing()) != 2 {
+		t.Errorf("expecting 2 secret keys, got %d", len(h.GetSecretKeyRing()))
+	}
+	testDecrypt(t, h, "locked@example.com")
+}
+
+// testDecrypt encrypts and signs a message with the keys of address and
+// checks that it can be decrypted and verified with the keys of h.
+func testDecrypt(t *testing.T, h *Home, address string) {
+	pub, _ := h.GetPublicKey(address)
+	sec, _ := h.GetSecretKey(address)
+	buf := new(bytes.Buffer)
+	w, err := openpgp.Encrypt(buf, openpgp.EntityList{pub}, sec, nil, nil)
+	if err != nil {
+		t.Fatalf("error encrypting to %s: %v", address, err)
+	}
+	w.Write([]byte("hello"))
+	w.Close()
+
+	keys := append(h.GetPublicKeyRing(), h.GetSecretKeyRing()...)
+	md, err := openpgp.ReadMessage(buf, keys, nil, nil)
+	if err != nil {
+		t.Fatalf("error decrypting message to %s: %v", address, err)
+	}
+	body, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil || string(body) != "hello" {
+		t.Errorf("error reading message to %s: %v", address, err)
+	}
+	if md.SignatureError != nil || md.SignedBy == nil {
+		t.Errorf("signature by %s not verified: %v", address, md.SignatureError)
+	}
+}
+
+func TestOpenLegacy(t *testing.T) {
+	h, err := Open("testdata/legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.GetPublicKeyRing()) != 2 {
+		t.Fatalf("expecting 2 public keys, got %d", len(h.GetPublicKeyRing()))
+	}
+	if k, _ := h.GetPublicKey("locked@example.com"); k == nil || len(k.Subkeys) != 1 {
+		t.Error("public key not read from pubring.gpg")
+	}
+	if len(h.GetSecretKeyRing()) != 0 {
+		t.Error("expecting no secret keys")
+	}
+}
+
+func TestKeygrip(t *testing.T) {
+	h, err := Open("testdata/home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, _ := h.GetPublicKey("plain@example.com")
+	grip, err := Keygrip(k.PrimaryKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := hex.EncodeToString(grip); g != "7424e9cb27ca346c785c4215d0a072e3de09832f" {
+		t.Errorf("unexpected keygrip %s", g)
+	}
+}
+
+// TestUnprotectCBC checks keys protected as by GnuPG 2.1, which stores key
+// files as canonical S-expressions and encrypts them in CBC mode.
+func TestUnprotectCBC(t *testing.T) {
+	h, err := Open("testdata/home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, _ := h.GetSecretKey("plain@example.com")
+	priv := sk.PrivateKey.PrivateKey.(*rsa.PrivateKey)
+	p, q := priv.Primes[0], priv.Primes[1]
+	u := new(big.Int).ModInverse(p, q)
+
+	atom := func(b []byte) *sexp { return &sexp{atom: b} }
+	param := func(name string, b []byte) *sexp { return &sexp{list: []*sexp{atom([]byte(name)), atom(b)}} }
+	params := &sexp{list: []*sexp{
+		param("d", mpiBytes(priv.D)), param("p", mpiBytes(p)), param("q", mpiBytes(q)), param("u", mpiBytes(u)),
+	}}
+	// The hash covers the whole algorithm list of the unprotected key
+	plain := &sexp{list: append([]*sexp{atom([]byte("rsa")), param("n", mpiBytes(priv.N)), param("e", []byte{1, 0, 1})}, params.list...)}
+	sum := sha1.Sum(plain.canonical())
+
+	protect := func(sum []byte) *privateKey {
+		hash := &sexp{list: []*sexp{atom([]byte("hash")), atom([]byte("sha1")), atom(sum)}}
+		plaintext := (&sexp{list: []*sexp{params, hash}}).canonical()
+		plaintext = append(plaintext, make([]byte, aes.BlockSize-len(plaintext)%aes.BlockSize)...)
+
+		salt, iv := []byte("saltsalt"), bytes.Repeat([]byte{1}, aes.BlockSize)
+		block, _ := aes.NewCipher(s2kSHA1([]byte("cbc"), salt, 65536, 16))
+		ciphertext := make([]byte, len(plaintext))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+		protected := &sexp{list: []*sexp{
+			atom([]byte("protected")), atom([]byte("openpgp-s2k3-sha1-aes-cbc")),
+			&sexp{list: []*sexp{
+				&sexp{list: []*sexp{atom([]byte("sha1")), atom(salt), atom([]byte("65536"))}},
+				atom(iv),
+			}},
+			atom(ciphertext),
+		}}
+		key := &sexp{list: []*sexp{
+			atom([]byte("protected-private-key")),
+			&sexp{list: []*sexp{
+				atom([]byte("rsa")), param("n", mpiBytes(priv.N)), param("e", []byte{1, 0, 1}), protected,
+			}},
+		}}
+		k, err := readPrivateKey(key.canonical())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	k := protect(sum[:])
+	if _, err := k.privateKeyPacket(sk.PrimaryKey, []byte("wrong")); err == nil {
+		t.Error("expecting error unprotecting with wrong passphrase")
+	}
+	pk, err := k.privateKeyPacket(sk.PrimaryKey, []byte("cbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pk.PrivateKey.(*rsa.PrivateKey).D.Cmp(priv.D) != 0 {
+		t.Error("unprotected key does not match")
+	}
+
+	k = protect(make([]byte, 20))
+	if _, err := k.privateKeyPacket(sk.PrimaryKey, []byte("cbc")); err == nil {
+		t.Error("expecting error unprotecting key with wrong hash")
+	}
+}
+
+// TestOpenUnsupported checks that keys which are not supported are skipped
+// rather than stopping Open.
+func TestOpenUnsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gnupg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kbx, err := ioutil.ReadFile("testdata/home/pubring.kbx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An ed25519 public key, which the openpgp package cannot read
+	key := []byte{4, 0x55, 0, 0, 0, 22, 9, 0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f, 0x01, 0x01, 0x07, 0x40}
+	key = append(key, make([]byte, 32)...)
+	uid := []byte("Ed <ed@example.com>")
+	block := append(append([]byte{0xc6, byte(len(key))}, key...), append([]byte{0xcd, byte(len(uid))}, uid...)...)
+	blob := make([]byte, 16)
+	binary.BigEndian.PutUint32(blob, uint32(len(blob)+len(block)))
+	blob[4], blob[5] = blobOpenPGP, 1
+	binary.BigEndian.PutUint32(blob[8:], 16)
+	binary.BigEndian.PutUint32(blob[12:], uint32(len(block)))
+	kbx = append(kbx, append(blob, block...)...)
+	if err := ioutil.WriteFile(filepath.Join(dir, "pubring.kbx"), kbx, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readKeyring(block); err != nil {
+		t.Errorf("error reading keyring of unsupported key: %v", err)
+	}
+
+	// A stub for a key held on a smartcard in place of the unprotected key
+	keyDir := filepath.Join(dir, "private-keys-v1.d")
+	if err := os.Mkdir(keyDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	stub := []byte("(20:shadowed-private-key(3:rsa(1:n1:\x01)(1:e3:\x01\x00\x01)(8:shadowed5:t1-v1()))))")
+	if err := ioutil.WriteFile(filepath.Join(keyDir, "7424E9CB27CA346C785C4215D0A072E3DE09832F.key"), stub, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.GetPublicKeyRing()) != 2 {
+		t.Errorf("expecting 2 public keys, got %d", len(h.GetPublicKeyRing()))
+	}
+	if sk, _ := h.GetSecretKey("plain@example.com"); sk != nil {
+		t.Error("expecting no secret key for smartcard stub")
+	}
+}
+
+func TestOCB(t *testing.T) {
+	// Sample results from RFC 7253 appendix A
+	tests := []struct {
+		nonce, aad, plaintext, ciphertext string
+	}{
+		{"BBAA99887766554433221100", "", "", "785407BFFFC8AD9EDCC5520AC9111EE6"},
+		{"BBAA99887766554433221101", "0001020304050607", "0001020304050607", "6820B3657B6F615A5725BDA0D3B4EB3A257C9AF1F8F03009"},
+		{"BBAA99887766554433221102", "0001020304050607", "", "81017F8203F081277152FADE694A0A00"},
+		{"BBAA99887766554433221103", "", "0001020304050607", "45DD69F8F5AAE72414054CD1F35D82760B2CD00D2F99BFA9"},
+	}
+	key, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F")
+	block, _ := aes.NewCipher(key)
+	for _, tt := range tests {
+		nonce, _ := hex.DecodeString(tt.nonce)
+		aad, _ := hex.DecodeString(tt.aad)
+		ciphertext, _ := hex.DecodeString(tt.ciphertext)
+		plaintext, err := ocbOpen(block, nonce, ciphertext, aad)
+		if err != nil {
+			t.Errorf("nonce %s: %v", tt.nonce, err)
+			continue
+		}
+		if expected, _ := hex.DecodeString(tt.plaintext); !bytes.Equal(plaintext, expected) {
+			t.Errorf("nonce %s: unexpected plaintext %x", tt.nonce, plaintext)
+		}
+		ciphertext[0] ^= 1
+		if _, err := ocbOpen(block, nonce, ciphertext, aad); err == nil {
+			t.Errorf("nonce %s: expecting error for modified ciphertext", tt.nonce)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package gnupg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"code.google.com/p/go.crypto/openpgp"
+	pgperrors "code.google.com/p/go.crypto/openpgp/errors"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// Keybox blob types
+const (
+	blobEmpty   = 0
+	blobHeader  = 1
+	blobOpenPGP = 2
+	blobX509    = 3
+)
+
+// readKeybox reads the OpenPGP keys from a keybox file as written by
+// GnuPG 2.1 and later.  Each key is stored in a blob which starts with a
+// four byte length and a type byte.  OpenPGP blobs record the offset and
+// length of the keyblock, which holds the key in the usual packet format.
+// Keys which the openpgp package does not support are skipped.
+func readKeybox(data []byte) (openpgp.EntityList, error) {
+	var es openpgp.EntityList
+	for len(data) > 0 {
+		if len(data) < 6 {
+			return nil, errors.New("truncated keybox blob")
+		}
+		n := binary.BigEndian.Uint32(data)
+		if n < 6 || uint64(n) > uint64(len(data)) {
+			return nil, errors.New("invalid keybox blob length")
+		}
+		blob := data[:n]
+		data = data[n:]
+		if blob[4] != blobOpenPGP {
+			continue
+		}
+		if len(blob) < 16 {
+			return nil, errors.New("truncated OpenPGP keybox blob")
+		}
+		offset := binary.BigEndian.Uint32(blob[8:])
+		length := binary.BigEndian.Uint32(blob[12:])
+		if uint64(offset)+uint64(length) > uint64(len(blob)) {
+			return nil, errors.New("keyblock outside of keybox blob")
+		}
+		blockEs, err := readKeyring(blob[offset : offset+length])
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, blockEs...)
+	}
+	return es, nil
+}
+
+// readKeyring reads the keys in a keyring of OpenPGP packets, such as
+// pubring.gpg or a keybox keyblock, skipping the ring trust packets which
+// GnuPG stores after keys, user ids and signatures.  Keys which use an
+// algorithm the openpgp package does not support, such as ed25519, are
+// skipped.
+func readKeyring(data []byte) (openpgp.EntityList, error) {
+	buf := new(bytes.Buffer)
+	r := packet.NewOpaqueReader(bytes.NewReader(data))
+	for {
+		op, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if op.Tag == packetTypeTrust {
+			continue
+		}
+		if err := op.Serialize(buf); err != nil {
+			return nil, err
+		}
+	}
+	es, err := openpgp.ReadKeyRing(buf)
+	// ReadKeyRing skips unsupported keys itself unless there are no others
+	if _, ok := err.(pgperrors.UnsupportedError); ok {
+		return nil, nil
+	}
+	return es, err
+}
+
+const packetTypeTrust = 12
@@ -0,0 +1,147 @@
+package gnupg
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+const ocbTagSize = 16
+
+// ocbOpen decrypts and authenticates ciphertext, which ends with a 128 bit
+// tag, using OCB mode as specified in RFC 7253.  gpg-agent protects keys
+// with AES in this mode since GnuPG 2.2 and the Go libraries do not
+// provide it.
+func ocbOpen(b cipher.Block, nonce, ciphertext, aad []byte) ([]byte, error) {
+	if b.BlockSize() != 16 {
+		return nil, errors.New("OCB requires a 128 bit block cipher")
+	}
+	if len(nonce) == 0 || len(nonce) > 15 {
+		return nil, errors.New("invalid OCB nonce length")
+	}
+	if len(ciphertext) < ocbTagSize {
+		return nil, errors.New("OCB ciphertext too short")
+	}
+	tag := ciphertext[len(ciphertext)-ocbTagSize:]
+	ciphertext = ciphertext[:len(ciphertext)-ocbTagSize]
+
+	var lStar, lDollar [16]byte
+	b.Encrypt(lStar[:], lStar[:])
+	lDollar = ocbDouble(lStar)
+	l := []([16]byte){ocbDouble(lDollar)}
+	lAt := func(i int) [16]byte {
+		for len(l) <= i {
+			l = append(l, ocbDouble(l[len(l)-1]))
+		}
+		return l[i]
+	}
+
+	// The initial offset is derived from the nonce, with the tag length
+	// of 128 encoded as zero in its first bits
+	var n [16]byte
+	copy(n[16-len(nonce):], nonce)
+	n[15-len(nonce)] |= 1
+	bottom := uint(n[15] & 0x3f)
+	n[15] &= 0xc0
+	var ktop [16]byte
+	b.Encrypt(ktop[:], n[:])
+	var stretch [24]byte
+	copy(stretch[:], ktop[:])
+	for i := 0; i < 8; i++ {
+		stretch[16+i] = ktop[i] ^ ktop[i+1]
+	}
+	var offset [16]byte
+	for i := range offset {
+		offset[i] = stretch[i+int(bottom/8)] << (bottom % 8)
+		if bottom%8 != 0 {
+			offset[i] |= stretch[i+int(bottom/8)+1] >> (8 - bottom%8)
+		}
+	}
+
+	var checksum [16]byte
+	plaintext := make([]byte, len(ciphertext))
+	var tmp [16]byte
+	i := 0
+	for ; (i+1)*16 <= len(ciphertext); i++ {
+		xorBlock(&offset, lAt(ntz(i+1)))
+		for j := range tmp {
+			tmp[j] = ciphertext[i*16+j] ^ offset[j]
+		}
+		b.Decrypt(tmp[:], tmp[:])
+		for j := range tmp {
+			plaintext[i*16+j] = tmp[j] ^ offset[j]
+			checksum[j] ^= plaintext[i*16+j]
+		}
+	}
+	if rest := ciphertext[i*16:]; len(rest) > 0 {
+		xorBlock(&offset, lStar)
+		var pad [16]byte
+		b.Encrypt(pad[:], offset[:])
+		for j := range rest {
+			plaintext[i*16+j] = rest[j] ^ pad[j]
+			checksum[j] ^= plaintext[i*16+j]
+		}
+		checksum[len(rest)] ^= 0x80
+	}
+	xorBlock(&checksum, offset)
+	xorBlock(&checksum, lDollar)
+	var expected [16]byte
+	b.Encrypt(expected[:], checksum[:])
+	xorBlock(&expected, ocbHash(b, aad, lStar, lAt))
+	if subtle.ConstantTimeCompare(expected[:], tag) != 1 {
+		return nil, errors.New("OCB authentication failed")
+	}
+	return plaintext, nil
+}
+
+// ocbHash is the HASH function of RFC 7253 over the associated data.
+func ocbHash(b cipher.Block, aad []byte, lStar [16]byte, lAt func(int) [16]byte) [16]byte {
+	var sum, offset, tmp [16]byte
+	i := 0
+	for ; (i+1)*16 <= len(aad); i++ {
+		xorBlock(&offset, lAt(ntz(i+1)))
+		for j := range tmp {
+			tmp[j] = aad[i*16+j] ^ offset[j]
+		}
+		b.Encrypt(tmp[:], tmp[:])
+		xorBlock(&sum, tmp)
+	}
+	if rest := aad[i*16:]; len(rest) > 0 {
+		xorBlock(&offset, lStar)
+		tmp = [16]byte{}
+		copy(tmp[:], rest)
+		tmp[len(rest)] = 0x80
+		xorBlock(&tmp, offset)
+		b.Encrypt(tmp[:], tmp[:])
+		xorBlock(&sum, tmp)
+	}
+	return sum
+}
+
+func ocbDouble(s [16]byte) [16]byte {
+	var d [16]byte
+	for i := 0; i < 15; i++ {
+		d[i] = s[i]<<1 | s[i+1]>>7
+	}
+	d[15] = s[15] << 1
+	if s[0]&0x80 != 0 {
+		d[15] ^= 0x87
+	}
+	return d
+}
+
+func xorBlock(dst *[16]byte, src [16]byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// ntz returns the number of trailing zero bits of n.
+func ntz(n int) int {
+	z := 0
+	for n&1 == 0 {
+		n >>= 1
+		z++
+	}
+	return z
+}
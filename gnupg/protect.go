@@ -0,0 +1,238 @@
+package gnupg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/subtle"
+	"errors"
+	"math/big"
+	"strconv"
+
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// UnsupportedKeyError is returned for a private key which uses an algorithm,
+// protection mode or key file form which is not supported, such as the stubs
+// gpg-agent keeps for keys held on a smartcard.
+type UnsupportedKeyError string
+
+func (e UnsupportedKeyError) Error() string {
+	return "unsupported private key: " + string(e)
+}
+
+// Keygrip returns the keygrip which gpg-agent uses to name the file
+// holding the private part of pub.  Only RSA keys are supported.
+func Keygrip(pub *packet.PublicKey) ([]byte, error) {
+	rsaPub, ok := pub.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, UnsupportedKeyError("keygrip of unsupported key algorithm")
+	}
+	h := sha1.New()
+	h.Write(mpiBytes(rsaPub.N))
+	return h.Sum(nil), nil
+}
+
+// mpiBytes returns n as libgcrypt stores an unsigned integer, with a
+// leading zero byte if the top bit is set.
+func mpiBytes(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return b
+}
+
+// A privateKey is the parsed contents of a key file.  If the key is
+// protected the private parameters are only available after unprotect.
+type privateKey struct {
+	algo      *sexp
+	protected bool
+}
+
+func readPrivateKey(data []byte) (*privateKey, error) {
+	s, err := parseKeyFile(data)
+	if err != nil {
+		return nil, err
+	}
+	k := new(privateKey)
+	switch s.name() {
+	case "private-key":
+	case "protected-private-key":
+		k.protected = true
+	case "shadowed-private-key":
+		return nil, UnsupportedKeyError("private key is held by a smartcard or other token")
+	default:
+		return nil, errors.New("not a private key: " + s.name())
+	}
+	if len(s.list) < 2 || s.list[1].name() == "" {
+		return nil, errors.New("private key has no algorithm")
+	}
+	k.algo = s.list[1]
+	return k, nil
+}
+
+// privateKeyPacket returns the private key for pub.  A protected key is first
+// decrypted with passphrase.
+func (k *privateKey) privateKeyPacket(pub *packet.PublicKey, passphrase []byte) (*packet.PrivateKey, error) {
+	rsaPub, ok := pub.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, UnsupportedKeyError("public key algorithm is not RSA")
+	}
+	rsaPriv, err := k.rsaKey(rsaPub, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return &packet.PrivateKey{PublicKey: *pub, PrivateKey: rsaPriv}, nil
+}
+
+// rsaKey returns the RSA private key, which must match pub.  A protected
+// key is first decrypted with passphrase.
+func (k *privateKey) rsaKey(pub *rsa.PublicKey, passphrase []byte) (*rsa.PrivateKey, error) {
+	if k.algo.name() != "rsa" {
+		return nil, UnsupportedKeyError("private key algorithm " + k.algo.name())
+	}
+	params := k.algo
+	if k.protected {
+		var err error
+		if params, err = k.unprotect(passphrase); err != nil {
+			return nil, err
+		}
+	}
+	n := new(big.Int).SetBytes(k.algo.value("n"))
+	e := new(big.Int).SetBytes(k.algo.value("e"))
+	if n.Cmp(pub.N) != 0 || !e.IsInt64() || e.Int64() != int64(pub.E) {
+		return nil, errors.New("private key does not match public key")
+	}
+	priv := &rsa.PrivateKey{PublicKey: *pub}
+	priv.D = new(big.Int).SetBytes(params.value("d"))
+	p := new(big.Int).SetBytes(params.value("p"))
+	q := new(big.Int).SetBytes(params.value("q"))
+	priv.Primes = []*big.Int{p, q}
+	// Damaged key files are caught here
+	if err := priv.Validate(); err != nil {
+		return nil, errors.New("invalid private key parameters, passphrase may be incorrect")
+	}
+	priv.Precompute()
+	return priv, nil
+}
+
+// unprotect decrypts the protected parameters of k, which are stored as
+// (protected MODE ((sha1 SALT COUNT) IV) CIPHERTEXT) in the algorithm
+// list, and returns a list holding the private parameters.  The CBC mode
+// has no authentication, so the hash of the key stored along with the
+// parameters is checked instead.
+func (k *privateKey) unprotect(passphrase []byte) (*sexp, error) {
+	prot := k.algo.find("protected")
+	if prot == nil || len(prot.list) != 4 {
+		return nil, errors.New("protected key has no protected parameters")
+	}
+	mode := string(prot.list[1].atom)
+	params, ciphertext := prot.list[2], prot.list[3].atom
+	if !params.isList() || len(params.list) != 2 || params.list[0].name() != "sha1" || len(params.list[0].list) != 3 {
+		return nil, UnsupportedKeyError("key protection parameters")
+	}
+	salt, iv := params.list[0].list[1].atom, params.list[1].atom
+	count, err := strconv.Atoi(string(params.list[0].list[2].atom))
+	if err != nil || len(salt) != 8 || count <= 0 {
+		return nil, errors.New("invalid key protection parameters")
+	}
+	block, err := aes.NewCipher(s2kSHA1(passphrase, salt, count, 16))
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext []byte
+	switch mode {
+	case "openpgp-s2k3-ocb-aes":
+		plaintext, err = ocbOpen(block, iv, ciphertext, k.associatedData())
+		if err != nil {
+			return nil, errors.New("error decrypting private key, passphrase may be incorrect")
+		}
+	case "openpgp-s2k3-sha1-aes-cbc":
+		if len(iv) != aes.BlockSize || len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+			return nil, errors.New("invalid protected private key")
+		}
+		plaintext = make([]byte, len(ciphertext))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	default:
+		return nil, UnsupportedKeyError("key protection mode " + mode)
+	}
+	s, err := parseSexp(plaintext)
+	if err != nil {
+		return nil, errors.New("error parsing private key, passphrase may be incorrect")
+	}
+	// The parameters are wrapped in a further list, which in CBC mode is
+	// followed by a hash of the key: ((PARAMS...)(hash sha1 HASH))
+	if len(s.list) == 0 || !s.list[0].isList() || s.list[0].name() != "" {
+		return nil, errors.New("invalid private key, passphrase may be incorrect")
+	}
+	if mode == "openpgp-s2k3-ocb-aes" {
+		return s.list[0], nil
+	}
+	if len(s.list) != 2 {
+		return nil, errors.New("invalid private key hash, passphrase may be incorrect")
+	}
+	params, hash := s.list[0], s.list[1]
+	if hash.name() != "hash" || len(hash.list) != 3 || string(hash.list[1].atom) != "sha1" {
+		return nil, errors.New("invalid private key hash, passphrase may be incorrect")
+	}
+	if subtle.ConstantTimeCompare(k.hash(params), hash.list[2].atom) != 1 {
+		return nil, errors.New("private key hash does not match, passphrase may be incorrect")
+	}
+	return params, nil
+}
+
+// hash returns the hash which the CBC protection mode stores along with the
+// private parameters: the SHA-1 hash of the canonical algorithm list with
+// the protected list replaced by the parameters.
+func (k *privateKey) hash(params *sexp) []byte {
+	algo := &sexp{}
+	for _, e := range k.algo.list {
+		if e.name() == "protected" {
+			algo.list = append(algo.list, params.list...)
+		} else {
+			algo.list = append(algo.list, e)
+		}
+	}
+	h := sha1.Sum(algo.canonical())
+	return h[:]
+}
+
+// associatedData returns the data authenticated along with the parameters
+// protected in OCB mode: the canonical algorithm list without the
+// protected list.
+func (k *privateKey) associatedData() []byte {
+	algo := &sexp{}
+	for _, e := range k.algo.list {
+		if e.name() != "protected" {
+			algo.list = append(algo.list, e)
+		}
+	}
+	return algo.canonical()
+}
+
+// s2kSHA1 derives a key of size bytes from passphrase using the OpenPGP
+// iterated and salted S2K with SHA-1, where count is the number of bytes
+// hashed.
+func s2kSHA1(passphrase, salt []byte, count, size int) []byte {
+	var key []byte
+	combined := append(append([]byte{}, salt...), passphrase...)
+	if count < len(combined) {
+		count = len(combined)
+	}
+	for i := 0; len(key) < size; i++ {
+		h := sha1.New()
+		h.Write(make([]byte, i))
+		for n := count; n > 0; n -= len(combined) {
+			if n < len(combined) {
+				h.Write(combined[:n])
+			} else {
+				h.Write(combined)
+			}
+		}
+		key = h.Sum(key)
+	}
+	return key[:size]
+}
@@ -0,0 +1,271 @@
+package gnupg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+)
+
+// sexp is an S-expression as used by gpg-agent for private keys.  An
+// expression is either an atom or a list.
+type sexp struct {
+	atom []byte
+	list []*sexp
+}
+
+func (s *sexp) isList() bool {
+	return s.atom == nil
+}
+
+// name returns the first atom of a list, which gpg-agent uses as the name
+// of the list.
+func (s *sexp) name() string {
+	if !s.isList() || len(s.list) == 0 || s.list[0].isList() {
+		return ""
+	}
+	return string(s.list[0].atom)
+}
+
+// find returns the first list named name among the elements of s.
+func (s *sexp) find(name string) *sexp {
+	for _, e := range s.list {
+		if e.name() == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// value returns the atom following the name of the list named name, for
+// example the bytes of n in (rsa (n #00C1...#) ...).
+func (s *sexp) value(name string) []byte {
+	e := s.find(name)
+	if e == nil || len(e.list) < 2 || e.list[1].isList() {
+		return nil
+	}
+	return e.list[1].atom
+}
+
+// canonical returns the canonical encoding of s.
+func (s *sexp) canonical() []byte {
+	buf := new(bytes.Buffer)
+	s.writeCanonical(buf)
+	return buf.Bytes()
+}
+
+func (s *sexp) writeCanonical(buf *bytes.Buffer) {
+	if !s.isList() {
+		buf.WriteString(strconv.Itoa(len(s.atom)))
+		buf.WriteByte(':')
+		buf.Write(s.atom)
+		return
+	}
+	buf.WriteByte('(')
+	for _, e := range s.list {
+		e.writeCanonical(buf)
+	}
+	buf.WriteByte(')')
+}
+
+// parseSexp parses a single S-expression in either the canonical encoding
+// or the advanced encoding used by the extended key file format.  Any data
+// following the expression, such as cipher padding, is ignored.
+func parseSexp(data []byte) (*sexp, error) {
+	p := &sexpParser{data: data}
+	p.skipSpace()
+	if p.pos >= len(p.data) || p.data[p.pos] != '(' {
+		return nil, errors.New("S-expression does not start with a list")
+	}
+	return p.parse()
+}
+
+type sexpParser struct {
+	data []byte
+	pos  int
+}
+
+func (p *sexpParser) skipSpace() {
+	for p.pos < len(p.data) && isSpace(p.data[p.pos]) {
+		p.pos++
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == '\v'
+}
+
+func isTokenChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		bytes.IndexByte([]byte("-./_:*+="), c) != -1
+}
+
+func (p *sexpParser) parse() (*sexp, error) {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return nil, errors.New("unexpected end of S-expression")
+	}
+	c := p.data[p.pos]
+	switch {
+	case c == '(':
+		p.pos++
+		s := &sexp{list: []*sexp{}}
+		for {
+			p.skipSpace()
+			if p.pos >= len(p.data) {
+				return nil, errors.New("unterminated list in S-expression")
+			}
+			if p.data[p.pos] == ')' {
+				p.pos++
+				return s, nil
+			}
+			e, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			s.list = append(s.list, e)
+		}
+	case c == '#':
+		return p.parseDelimited('#', decodeHexAtom)
+	case c == '|':
+		return p.parseDelimited('|', decodeBase64Atom)
+	case c == '"':
+		return p.parseString()
+	case c >= '0' && c <= '9':
+		if s, ok, err := p.parseCanonicalAtom(); ok {
+			return s, err
+		}
+		return p.parseToken()
+	case isTokenChar(c):
+		return p.parseToken()
+	}
+	return nil, errors.New("unexpected character in S-expression: " + strconv.QuoteRune(rune(c)))
+}
+
+// parseCanonicalAtom parses an atom of the form "3:rsa".  It returns
+// false if the digits are not followed by a colon.
+func (p *sexpParser) parseCanonicalAtom() (*sexp, bool, error) {
+	end := p.pos
+	for end < len(p.data) && p.data[end] >= '0' && p.data[end] <= '9' {
+		end++
+	}
+	if end >= len(p.data) || p.data[end] != ':' {
+		return nil, false, nil
+	}
+	n, err := strconv.Atoi(string(p.data[p.pos:end]))
+	if err != nil || n > len(p.data)-end-1 {
+		return nil, true, errors.New("invalid atom length in S-expression")
+	}
+	start := end + 1
+	p.pos = start + n
+	return &sexp{atom: p.data[start:p.pos:p.pos]}, true, nil
+}
+
+func (p *sexpParser) parseToken() (*sexp, error) {
+	start := p.pos
+	for p.pos < len(p.data) && isTokenChar(p.data[p.pos]) {
+		p.pos++
+	}
+	return &sexp{atom: append([]byte{}, p.data[start:p.pos]...)}, nil
+}
+
+func (p *sexpParser) parseDelimited(delim byte, decode func([]byte) ([]byte, error)) (*sexp, error) {
+	end := bytes.IndexByte(p.data[p.pos+1:], delim)
+	if end == -1 {
+		return nil, errors.New("unterminated atom in S-expression")
+	}
+	raw := p.data[p.pos+1 : p.pos+1+end]
+	p.pos += end + 2
+	atom, err := decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &sexp{atom: atom}, nil
+}
+
+// decodeHexAtom decodes a #...# atom, which may be broken across lines.
+func decodeHexAtom(raw []byte) ([]byte, error) {
+	atom, err := hex.DecodeString(string(removeSpace(raw)))
+	if err != nil {
+		return nil, errors.New("invalid hex atom in S-expression: " + err.Error())
+	}
+	return atom, nil
+}
+
+func decodeBase64Atom(raw []byte) ([]byte, error) {
+	atom, err := base64.StdEncoding.DecodeString(string(removeSpace(raw)))
+	if err != nil {
+		return nil, errors.New("invalid base64 atom in S-expression: " + err.Error())
+	}
+	return atom, nil
+}
+
+func removeSpace(raw []byte) []byte {
+	var out []byte
+	for _, c := range raw {
+		if !isSpace(c) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (p *sexpParser) parseString() (*sexp, error) {
+	atom := []byte{}
+	for p.pos++; p.pos < len(p.data); p.pos++ {
+		c := p.data[p.pos]
+		switch c {
+		case '"':
+			p.pos++
+			return &sexp{atom: atom}, nil
+		case '\\':
+			p.pos++
+			if p.pos >= len(p.data) {
+				break
+			}
+			switch e := p.data[p.pos]; e {
+			case 'n':
+				atom = append(atom, '\n')
+			case 'r':
+				atom = append(atom, '\r')
+			case 't':
+				atom = append(atom, '\t')
+			default:
+				atom = append(atom, e)
+			}
+		default:
+			atom = append(atom, c)
+		}
+	}
+	return nil, errors.New("unterminated string in S-expression")
+}
+
+// parseKeyFile parses a file from private-keys-v1.d.  Older versions of
+// GnuPG store the key as a canonical S-expression, newer versions use the
+// extended format of "Name: value" items with the key in the Key item.
+func parseKeyFile(data []byte) (*sexp, error) {
+	if len(data) > 0 && data[0] == '(' {
+		return parseSexp(data)
+	}
+	var key []byte
+	inKey := false
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) > 0 && isSpace(line[0]) {
+			if inKey {
+				key = append(key, '\n')
+				key = append(key, bytes.TrimSpace(line)...)
+			}
+			continue
+		}
+		inKey = false
+		if bytes.HasPrefix(line, []byte("Key:")) {
+			inKey = true
+			key = append(key, bytes.TrimSpace(line[4:])...)
+		}
+	}
+	if key == nil {
+		return nil, errors.New("no Key item in key file")
+	}
+	return parseSexp(key)
+}
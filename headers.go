@@ -0,0 +1,219 @@
+package pgpmail
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+)
+
+// maximum length of a line of a header encoded with RFC 2047 encoded-words
+const encodedHeaderLineLength = 76
+
+// preferred maximum length of a rendered header line (RFC 5322 section 2.1.1)
+const foldedHeaderLineLength = 78
+
+var headerDecoder = new(mime.WordDecoder)
+
+var addressParser = &mail.AddressParser{WordDecoder: headerDecoder}
+
+// addressHeaders are the headers which contain address lists and so must
+// have only the display names of addresses encoded.
+var addressHeaders = map[string]bool{
+	"From":     true,
+	"Sender":   true,
+	"Reply-To": true,
+	"To":       true,
+	"Cc":       true,
+	"Bcc":      true,
+}
+
+// DecodedValue returns Value with any RFC 2047 encoded-words decoded.
+func (h *Header) DecodedValue() (string, error) {
+	if h.encode {
+		return h.Value, nil
+	}
+	return headerDecoder.DecodeHeader(h.Value)
+}
+
+// GetDecodedHeader returns the value of the first header matching name with
+// any RFC 2047 encoded-words decoded.  If the value cannot be decoded it is
+// returned unchanged.  Returns "" if no such header exists.
+func (m *MessagePart) GetDecodedHeader(name string) string {
+	h := m.findFirstHeader(name)
+	if h == nil {
+		return ""
+	}
+	return decodeHeaderValue(h)
+}
+
+// GetDecodedHeaders returns the values of all headers matching name with
+// any RFC 2047 encoded-words decoded.
+func (m *MessagePart) GetDecodedHeaders(name string) []string {
+	key := CanonicalMIMEHeaderKey(name)
+	ret := []string{}
+	for _, h := range m.HeaderList {
+		if h.Name == key {
+			ret = append(ret, decodeHeaderValue(h))
+		}
+	}
+	return ret
+}
+
+func decodeHeaderValue(h *Header) string {
+	v, err := h.DecodedValue()
+	if err != nil {
+		logger.Warning("Error decoding header " + h.Name + ": " + err.Error())
+		return h.Value
+	}
+	return v
+}
+
+// AddEncodedHeader adds a header with an unencoded, possibly non-ASCII
+// value.  When the message is rendered, non-ASCII text is encoded as RFC
+// 2047 encoded-words and the header is folded.  For address headers such
+// as To and From only the display names are encoded.
+func (m *MessagePart) AddEncodedHeader(name, value string) {
+	m.AddHeader(name, value)
+	m.HeaderList[len(m.HeaderList)-1].encode = true
+}
+
+// SetEncodedHeader is like SetHeader but encodes the value as described
+// for AddEncodedHeader.
+func (m *MessagePart) SetEncodedHeader(name, value string) {
+	h := m.findFirstHeader(name)
+	if h == nil {
+		m.AddEncodedHeader(name, value)
+	} else {
+		h.Value = value
+		h.encode = true
+	}
+}
+
+// render returns the text of h with long values folded at whitespace,
+// using eol as the line ending between folded lines.  Folding keeps lines
+// within 78 characters where the value allows it, and so well within the
+// hard limit of 998.
+func (h *Header) render(eol []byte) string {
+	if h.encode {
+		return encodeHeader(h.Name, h.Value, eol)
+	}
+	s := h.String()
+	if len(s) <= foldedHeaderLineLength {
+		return s
+	}
+	return foldHeader(h.Name, h.Value, foldedHeaderLineLength, eol)
+}
+
+// encodeHeader renders a header line with the unencoded value encoded as
+// RFC 2047 encoded-words where needed and folded at whitespace.
+func encodeHeader(name, value string, eol []byte) string {
+	encoded := value
+	if addressHeaders[name] {
+		encoded = encodeAddressList(value)
+	} else if !is7Bit([]byte(value)) {
+		encoded = encodeWords(value, encodedHeaderLineLength-len(name)-len(": "))
+	}
+	return foldHeader(name, encoded, encodedHeaderLineLength, eol)
+}
+
+// maximum length of an RFC 2047 encoded-word
+const maxEncodedWordLength = 75
+
+// encodeWords encodes value as a sequence of RFC 2047 Q encoded-words
+// separated by spaces.  The first word is at most first characters long so
+// that it fits on the line after the field name, and so the header is never
+// folded directly after its name.
+func encodeWords(value string, first int) string {
+	const prefix, suffix = "=?utf-8?q?", "?="
+	var words []string
+	max := first
+	if max > maxEncodedWordLength {
+		max = maxEncodedWordLength
+	}
+	word := prefix
+	for _, r := range value {
+		enc := qEncodeRune(r)
+		if len(word)+len(enc)+len(suffix) > max && len(word) > len(prefix) {
+			words = append(words, word+suffix)
+			word = prefix
+			max = maxEncodedWordLength
+		}
+		word += enc
+	}
+	words = append(words, word+suffix)
+	return strings.Join(words, " ")
+}
+
+// qEncodeRune returns r in the Q encoding, keeping only the characters
+// which RFC 2047 allows unencoded anywhere in a header.
+func qEncodeRune(r rune) string {
+	if r == ' ' {
+		return "_"
+	}
+	var b bytes.Buffer
+	for _, c := range []byte(string(r)) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', strings.IndexByte("!*+-/", c) != -1:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "=%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func encodeAddressList(value string) string {
+	as, err := mail.ParseAddressList(value)
+	if err != nil {
+		logger.Warning("Failed to parse address list for encoding " + value)
+		return mime.QEncoding.Encode("utf-8", value)
+	}
+	ss := make([]string, len(as))
+	for i, a := range as {
+		ss[i] = a.String()
+	}
+	return strings.Join(ss, ", ")
+}
+
+// foldHeader renders a header, inserting line breaks before whitespace in
+// value so that lines do not exceed lineLength where possible.  The
+// whitespace is kept, so removing the line breaks gives the unfolded
+// header.  The first word of value always stays on the line with the
+// field name.
+func foldHeader(name, value string, lineLength int, eol []byte) string {
+	b := new(bytes.Buffer)
+	b.WriteString(name)
+	b.WriteString(":")
+	if value == "" {
+		return b.String()
+	}
+	b.WriteString(" ")
+	word, value := nextHeaderWord(value)
+	b.WriteString(word)
+	lineLen := b.Len()
+	for value != "" {
+		word, value = nextHeaderWord(value)
+		if lineLen+len(word) > lineLength {
+			b.Write(eol)
+			lineLen = 0
+		}
+		b.WriteString(word)
+		lineLen += len(word)
+	}
+	return b.String()
+}
+
+// nextHeaderWord splits s after its leading whitespace and the word which
+// follows it.
+func nextHeaderWord(s string) (string, string) {
+	i := 0
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	for i < len(s) && s[i] != ' ' && s[i] != '\t' {
+		i++
+	}
+	return s[:i], s[i:]
+}
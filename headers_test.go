@@ -0,0 +1,141 @@
+package pgpmail
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestGetDecodedHeader(t *testing.T) {
+	td := new(TestData)
+	td.From = "=?ISO-8859-1?Q?J=F6rg_M=FCller?= <jorg@example.com>"
+	td.Subject = "=?UTF-8?B?w5xiZXJwcsO8ZnVuZw==?= der =?UTF-8?Q?Verschl=C3=BCsselung?="
+	m := td.Message()
+
+	if s := m.GetDecodedHeader("subject"); s != "Überprüfung der Verschlüsselung" {
+		t.Errorf("subject not decoded correctly: %q", s)
+	}
+	if s := m.GetHeaderValue("Subject"); s != td.Subject {
+		t.Error("raw header value should not be decoded")
+	}
+	if fs := m.GetDecodedHeaders("From"); len(fs) != 1 || fs[0] != "Jörg Müller <jorg@example.com>" {
+		t.Errorf("from header not decoded correctly: %v", fs)
+	}
+	if s := m.GetDecodedHeader("X-Missing"); s != "" {
+		t.Error("expecting empty string for missing header")
+	}
+	if a := getSenderAddress(m); a != "jorg@example.com" {
+		t.Errorf("sender address not extracted from encoded header: %q", a)
+	}
+}
+
+func TestSetEncodedHeader(t *testing.T) {
+	subject := strings.Repeat("Grüße aus Köln, ", 6)
+	td := new(TestData)
+	m := td.Message()
+	m.SetEncodedHeader("Subject", subject)
+	m.SetEncodedHeader("To", "Zoë Ångström <zoe@example.com>, plain@example.com")
+	m.AddEncodedHeader("X-Ascii", "nothing to encode")
+
+	if m.GetHeaderValue("Subject") != subject {
+		t.Error("header value should hold unencoded text")
+	}
+	out := m.String()
+	header := out[:strings.Index(out, "\r\n\r\n")]
+	for _, line := range strings.Split(header, "\r\n") {
+		if len(line) > encodedHeaderLineLength {
+			t.Errorf("encoded header line exceeds %d characters: %q", encodedHeaderLineLength, line)
+		}
+		if !is7Bit([]byte(line)) {
+			t.Errorf("encoded header line contains non-ASCII characters: %q", line)
+		}
+	}
+	if !strings.Contains(header, "Subject: =?utf-8?q?") {
+		t.Error("encoded subject folded after field name")
+	}
+	if !strings.Contains(header, "X-Ascii: nothing to encode") {
+		t.Error("ASCII header value should not be encoded")
+	}
+
+	m2, err := ParseMessage(out)
+	if err != nil {
+		t.Fatal("error parsing message with encoded headers: " + err.Error())
+	}
+	if s := m2.GetDecodedHeader("Subject"); s != subject {
+		t.Errorf("encoded subject did not round trip: %q", s)
+	}
+	as := getRecipientAddresses(m2, DefaultOptions())
+	if len(as) < 2 || as[0] != "zoe@example.com" || as[1] != "plain@example.com" {
+		t.Errorf("recipient addresses not parsed from encoded header: %v", as)
+	}
+	if s := m2.GetDecodedHeader("To"); !strings.HasPrefix(s, "Zoë Ångström") {
+		t.Errorf("encoded display name did not round trip: %q", s)
+	}
+}
+
+func TestFoldLongHeaders(t *testing.T) {
+	var rcpts []string
+	for i := 0; i < 100; i++ {
+		rcpts = append(rcpts, fmt.Sprintf("recipient%d@example.com", i))
+	}
+	to := strings.Join(rcpts, ", ")
+	folded := "X-Folded: this header was\r\n folded by the sender"
+	msg := "From: from@example.com\r\n" + folded + "\r\nSubject: Test\r\n\r\nbody"
+	m, err := ParseMessage(msg)
+	if err != nil {
+		t.Fatal("error parsing message: " + err.Error())
+	}
+	m.SetHeader("To", to)
+	m.SetHeader("Subject", "A short subject")
+
+	out := m.String()
+	header := out[:strings.Index(out, "\r\n\r\n")]
+	for _, line := range strings.Split(header, "\r\n") {
+		if len(line) > foldedHeaderLineLength {
+			t.Errorf("header line exceeds %d characters: %q", foldedHeaderLineLength, line)
+		}
+	}
+	if !strings.Contains(header, folded+"\r\n") {
+		t.Error("folded header from parsed message was not preserved")
+	}
+	if !strings.Contains(header, "Subject: A short subject\r\n") {
+		t.Error("short header should not be folded")
+	}
+
+	m2, err := ParseMessage(out)
+	if err != nil {
+		t.Fatal("error parsing message with folded headers: " + err.Error())
+	}
+	if m2.GetHeaderValue("To") != to {
+		t.Errorf("folded header does not unfold to original value: %q", m2.GetHeaderValue("To"))
+	}
+
+	m.headerEnd = "\n"
+	if out := m.String(); strings.Contains(out, ",\r\n ") || !strings.Contains(out, ",\n ") {
+		t.Error("header folded with CRLF in message with LF line endings")
+	}
+}
+
+func TestFoldKeepsWhitespace(t *testing.T) {
+	value := strings.Repeat("words\tand  spaces ", 10) + "end"
+	h := &Header{Name: "X-Spacing", Value: value}
+	out := h.render(crlf)
+	if strings.Replace(out, "\r\n", "", -1) != "X-Spacing: "+value {
+		t.Errorf("folding changed header whitespace: %q", out)
+	}
+	for _, line := range strings.Split(out, "\r\n") {
+		if len(line) > foldedHeaderLineLength {
+			t.Errorf("header line exceeds %d characters: %q", foldedHeaderLineLength, line)
+		}
+	}
+
+	id := "<" + strings.Repeat("0123456789", 8) + "@example.com>"
+	h = &Header{Name: "Message-Id", Value: id}
+	if out := h.render(crlf); out != "Message-Id: "+id {
+		t.Errorf("header without whitespace was folded: %q", out)
+	}
+	h.Value = id + " (comment)"
+	if out := h.render(crlf); !strings.HasPrefix(out, "Message-Id: "+id+"\r\n") {
+		t.Errorf("header folded after field name: %q", out)
+	}
+}
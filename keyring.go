@@ -0,0 +1,426 @@
+package pgpmail
+
+import (
+	"sync"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// KeyRing is a KeySource which holds keys in memory.  Keys are indexed by
+// the ids of their primary keys and subkeys, by fingerprint and by the
+// email addresses of their identities, which are compared as normalized by
+// DefaultAddressNormalization unless SetAddressNormalization is called.  A
+// KeyRing is safe for concurrent use and the zero value is an empty
+// KeyRing.
+type KeyRing struct {
+	mu      sync.RWMutex
+	pubkeys keyIndex
+	seckeys keyIndex
+}
+
+// keyIndex holds a list of entities in the order in which they were added
+// along with maps for looking them up.
+type keyIndex struct {
+	entities      openpgp.EntityList
+	byKeyId       map[uint64]openpgp.EntityList
+	bySubkeyId    map[uint64]openpgp.EntityList
+	byFingerprint map[[20]byte]*openpgp.Entity
+	byEmail       map[string]openpgp.EntityList
+	// norm normalizes the addresses in byEmail, or is nil for
+	// DefaultAddressNormalization
+	norm *AddressNormalization
+}
+
+// AddPublicKey adds k to the public keys.  If a key with the same primary
+// key fingerprint is already present the new identities, subkeys and
+// signatures of k are merged into a copy of it, which replaces it.
+func (kr *KeyRing) AddPublicKey(k *openpgp.Entity) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.pubkeys.add(k)
+}
+
+// AddSecretKey adds k to the secret keys, merging it with any key with the
+// same primary key fingerprint as for AddPublicKey.
+func (kr *KeyRing) AddSecretKey(k *openpgp.Entity) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.seckeys.add(k)
+}
+
+// Replace stores k in place of the public key with the same primary key
+// fingerprint without merging, or adds it if there is none.  If k has a
+// private key it also replaces the secret key.
+func (kr *KeyRing) Replace(k *openpgp.Entity) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.pubkeys.set(k)
+	if k.PrivateKey != nil {
+		kr.seckeys.set(k)
+	}
+}
+
+// Remove deletes the public and secret keys with the given primary key
+// fingerprint and returns true if any key was removed.
+func (kr *KeyRing) Remove(fingerprint [20]byte) bool {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	pub := kr.pubkeys.remove(fingerprint)
+	sec := kr.seckeys.remove(fingerprint)
+	return pub || sec
+}
+
+// SetAddressNormalization changes how addresses are compared when keys are
+// looked up by email address, and indexes the keys again.
+func (kr *KeyRing) SetAddressNormalization(an AddressNormalization) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.pubkeys.setNormalization(&an)
+	kr.seckeys.setNormalization(&an)
+}
+
+func (kr *KeyRing) GetPublicKeyRing() openpgp.EntityList {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.pubkeys.list()
+}
+
+func (kr *KeyRing) GetPublicKey(address string) (*openpgp.Entity, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.pubkeys.firstByEmail(address), nil
+}
+
+func (kr *KeyRing) GetAllPublicKeys(address string) (openpgp.EntityList, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.pubkeys.allByEmail(address), nil
+}
+
+func (kr *KeyRing) GetPublicKeyById(keyid uint64) *openpgp.Entity {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.pubkeys.byId(keyid)
+}
+
+// GetPublicKeyByFingerprint returns the public key with the given primary
+// key fingerprint, or nil if there is none.
+func (kr *KeyRing) GetPublicKeyByFingerprint(fingerprint [20]byte) *openpgp.Entity {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.pubkeys.byFingerprint[fingerprint]
+}
+
+func (kr *KeyRing) GetSecretKeyRing() openpgp.EntityList {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.seckeys.list()
+}
+
+func (kr *KeyRing) GetSecretKey(address string) (*openpgp.Entity, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.seckeys.firstByEmail(address), nil
+}
+
+func (kr *KeyRing) GetAllSecretKeys(address string) (openpgp.EntityList, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.seckeys.allByEmail(address), nil
+}
+
+func (kr *KeyRing) GetSecretKeyById(keyid uint64) *openpgp.Entity {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.seckeys.byId(keyid)
+}
+
+// GetSecretKeyByFingerprint returns the secret key with the given primary
+// key fingerprint, or nil if there is none.
+func (kr *KeyRing) GetSecretKeyByFingerprint(fingerprint [20]byte) *openpgp.Entity {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.seckeys.byFingerprint[fingerprint]
+}
+
+// add stores e, merging it into any entity with the same primary key
+// fingerprint.  The stored entity is left alone if e adds nothing to it.
+func (ki *keyIndex) add(e *openpgp.Entity) {
+	if old := ki.byFingerprint[e.PrimaryKey.Fingerprint]; old != nil {
+		merged := copyEntity(old)
+		if mergeEntity(merged, e) {
+			ki.replace(old, merged)
+		}
+		return
+	}
+	ki.entities = append(ki.entities, e)
+	ki.index(e)
+}
+
+// set stores e in place of any entity with the same primary key
+// fingerprint, or adds it if there is none.
+func (ki *keyIndex) set(e *openpgp.Entity) {
+	if old := ki.byFingerprint[e.PrimaryKey.Fingerprint]; old != nil {
+		ki.replace(old, e)
+		return
+	}
+	ki.entities = append(ki.entities, e)
+	ki.index(e)
+}
+
+// replace swaps the stored entity old for e.
+func (ki *keyIndex) replace(old, e *openpgp.Entity) {
+	ki.unindex(old)
+	for i, k := range ki.entities {
+		if k == old {
+			ki.entities[i] = e
+		}
+	}
+	ki.index(e)
+}
+
+// remove deletes the entity with the given primary key fingerprint and
+// returns true if there was one.
+func (ki *keyIndex) remove(fingerprint [20]byte) bool {
+	e := ki.byFingerprint[fingerprint]
+	if e == nil {
+		return false
+	}
+	ki.unindex(e)
+	ki.entities = removeEntity(ki.entities, e)
+	return true
+}
+
+func (ki *keyIndex) index(e *openpgp.Entity) {
+	if ki.byFingerprint == nil {
+		ki.byKeyId = make(map[uint64]openpgp.EntityList)
+		ki.bySubkeyId = make(map[uint64]openpgp.EntityList)
+		ki.byFingerprint = make(map[[20]byte]*openpgp.Entity)
+		ki.byEmail = make(map[string]openpgp.EntityList)
+	}
+	ki.byKeyId[e.PrimaryKey.KeyId] = append(ki.byKeyId[e.PrimaryKey.KeyId], e)
+	for _, sk := range e.Subkeys {
+		ki.bySubkeyId[sk.PublicKey.KeyId] = append(ki.bySubkeyId[sk.PublicKey.KeyId], e)
+	}
+	ki.byFingerprint[e.PrimaryKey.Fingerprint] = e
+	for _, email := range ki.entityEmails(e) {
+		ki.byEmail[email] = append(ki.byEmail[email], e)
+	}
+}
+
+func (ki *keyIndex) unindex(e *openpgp.Entity) {
+	removeIndexed(ki.byKeyId, e.PrimaryKey.KeyId, e)
+	for _, sk := range e.Subkeys {
+		removeIndexed(ki.bySubkeyId, sk.PublicKey.KeyId, e)
+	}
+	delete(ki.byFingerprint, e.PrimaryKey.Fingerprint)
+	for _, email := range ki.entityEmails(e) {
+		if es := removeEntity(ki.byEmail[email], e); len(es) > 0 {
+			ki.byEmail[email] = es
+		} else {
+			delete(ki.byEmail, email)
+		}
+	}
+}
+
+func removeIndexed(m map[uint64]openpgp.EntityList, keyid uint64, e *openpgp.Entity) {
+	if es := removeEntity(m[keyid], e); len(es) > 0 {
+		m[keyid] = es
+	} else {
+		delete(m, keyid)
+	}
+}
+
+// removeEntity returns a copy of es without e.
+func removeEntity(es openpgp.EntityList, e *openpgp.Entity) openpgp.EntityList {
+	var kept openpgp.EntityList
+	for _, k := range es {
+		if k != e {
+			kept = append(kept, k)
+		}
+	}
+	return kept
+}
+
+// list returns a copy of the entities so that callers may use it while the
+// KeyRing is changed.
+func (ki *keyIndex) list() openpgp.EntityList {
+	return append(openpgp.EntityList{}, ki.entities...)
+}
+
+// byId returns the entity with a primary key or subkey matching keyid.
+func (ki *keyIndex) byId(keyid uint64) *openpgp.Entity {
+	if es := ki.byKeyId[keyid]; len(es) > 0 {
+		return es[0]
+	}
+	if es := ki.bySubkeyId[keyid]; len(es) > 0 {
+		return es[0]
+	}
+	return nil
+}
+
+func (ki *keyIndex) firstByEmail(email string) *openpgp.Entity {
+	es := ki.byEmail[ki.normalize(email)]
+	if len(es) == 0 {
+		return nil
+	}
+	return es[0]
+}
+
+func (ki *keyIndex) allByEmail(email string) openpgp.EntityList {
+	es := ki.byEmail[ki.normalize(email)]
+	if len(es) == 0 {
+		return nil
+	}
+	return append(openpgp.EntityList{}, es...)
+}
+
+// setNormalization replaces the address normalization and rebuilds the
+// email index.
+func (ki *keyIndex) setNormalization(an *AddressNormalization) {
+	ki.norm = an
+	if ki.byEmail == nil {
+		return
+	}
+	ki.byEmail = make(map[string]openpgp.EntityList)
+	for _, e := range ki.entities {
+		for _, email := range ki.entityEmails(e) {
+			ki.byEmail[email] = append(ki.byEmail[email], e)
+		}
+	}
+}
+
+func (ki *keyIndex) normalize(email string) string {
+	if ki.norm == nil {
+		return DefaultAddressNormalization.Normalize(email)
+	}
+	return ki.norm.Normalize(email)
+}
+
+// entityEmails returns the distinct normalized email addresses of the
+// identities of e.
+func (ki *keyIndex) entityEmails(e *openpgp.Entity) []string {
+	var emails []string
+	seen := make(map[string]bool)
+	for _, id := range e.Identities {
+		email := identityEmail(id)
+		if email == "" {
+			continue
+		}
+		email = ki.normalize(email)
+		if seen[email] {
+			continue
+		}
+		seen[email] = true
+		emails = append(emails, email)
+	}
+	return emails
+}
+
+// copyEntity returns a copy of e which can be changed without affecting
+// e, which may be in use by readers of the KeyRing.
+func copyEntity(e *openpgp.Entity) *openpgp.Entity {
+	c := *e
+	c.Identities = make(map[string]*openpgp.Identity, len(e.Identities))
+	for name, id := range e.Identities {
+		idc := *id
+		idc.Signatures = append([]*packet.Signature{}, id.Signatures...)
+		c.Identities[name] = &idc
+	}
+	c.Revocations = append([]*packet.Signature{}, e.Revocations...)
+	c.Subkeys = append([]openpgp.Subkey{}, e.Subkeys...)
+	return &c
+}
+
+// mergeEntity adds the identities, subkeys, signatures and revocations of
+// src which are missing from dst to dst.  Newer self-signatures and subkey
+// binding signatures replace older ones so that changes such as updated
+// expiry times take effect, and private keys are added where dst has none.
+// It returns true if dst was changed.
+func mergeEntity(dst, src *openpgp.Entity) bool {
+	changed := false
+	if dst.PrivateKey == nil && src.PrivateKey != nil {
+		dst.PrivateKey = src.PrivateKey
+		changed = true
+	}
+	var c bool
+	dst.Revocations, c = mergeSignatures(dst.Revocations, src.Revocations)
+	changed = changed || c
+	for name, id := range src.Identities {
+		did, ok := dst.Identities[name]
+		if !ok {
+			dst.Identities[name] = id
+			changed = true
+			continue
+		}
+		if isNewerSignature(id.SelfSignature, did.SelfSignature) {
+			did.SelfSignature = id.SelfSignature
+			changed = true
+		}
+		did.Signatures, c = mergeSignatures(did.Signatures, id.Signatures)
+		changed = changed || c
+	}
+	for _, sk := range src.Subkeys {
+		i := findSubkey(dst.Subkeys, sk.PublicKey.Fingerprint)
+		if i == -1 {
+			dst.Subkeys = append(dst.Subkeys, sk)
+			changed = true
+			continue
+		}
+		if isNewerSignature(sk.Sig, dst.Subkeys[i].Sig) {
+			dst.Subkeys[i].Sig = sk.Sig
+			changed = true
+		}
+		if dst.Subkeys[i].PrivateKey == nil && sk.PrivateKey != nil {
+			dst.Subkeys[i].PrivateKey = sk.PrivateKey
+			changed = true
+		}
+	}
+	return changed
+}
+
+func findSubkey(subkeys []openpgp.Subkey, fingerprint [20]byte) int {
+	for i, sk := range subkeys {
+		if sk.PublicKey.Fingerprint == fingerprint {
+			return i
+		}
+	}
+	return -1
+}
+
+func isNewerSignature(sig, than *packet.Signature) bool {
+	return sig != nil && (than == nil || sig.CreationTime.After(than.CreationTime))
+}
+
+// mergeSignatures appends the signatures of src which are not in dst and
+// reports whether any were added.
+func mergeSignatures(dst, src []*packet.Signature) ([]*packet.Signature, bool) {
+	changed := false
+	for _, sig := range src {
+		if !containsSignature(dst, sig) {
+			dst = append(dst, sig)
+			changed = true
+		}
+	}
+	return dst, changed
+}
+
+// containsSignature returns true if sigs has a signature of the same type
+// made by the same key at the same time as sig.
+func containsSignature(sigs []*packet.Signature, sig *packet.Signature) bool {
+	for _, s := range sigs {
+		if s.SigType == sig.SigType && s.CreationTime.Equal(sig.CreationTime) &&
+			issuerKeyId(s) == issuerKeyId(sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func issuerKeyId(sig *packet.Signature) uint64 {
+	if sig.IssuerKeyId == nil {
+		return 0
+	}
+	return *sig.IssuerKeyId
+}
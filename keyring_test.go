@@ -0,0 +1,161 @@
+package pgpmail
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func createTestKeyRing() *KeyRing {
+	kr := new(KeyRing)
+	pub, sec := loadTestKeyring()
+	for _, k := range pub {
+		kr.AddPublicKey(k)
+	}
+	for _, k := range sec {
+		kr.AddSecretKey(k)
+	}
+	return kr
+}
+
+func TestKeyRingLookup(t *testing.T) {
+	kr := createTestKeyRing()
+	k, _ := kr.GetPublicKey("user1@example.com")
+	if k == nil {
+		t.Fatal("public key not found by email address")
+	}
+	if k2, _ := kr.GetPublicKey("User1@EXAMPLE.com"); k2 != k {
+		t.Error("public key not found by email address with different case")
+	}
+	if ks, _ := kr.GetAllPublicKeys("user1@example.com"); len(ks) != 1 || ks[0] != k {
+		t.Errorf("expecting one public key for address, got %d", len(ks))
+	}
+	if kr.GetPublicKeyById(k.PrimaryKey.KeyId) != k {
+		t.Error("public key not found by key id")
+	}
+	for _, sk := range k.Subkeys {
+		if kr.GetPublicKeyById(sk.PublicKey.KeyId) != k {
+			t.Error("public key not found by subkey id")
+		}
+	}
+	if kr.GetPublicKeyByFingerprint(k.PrimaryKey.Fingerprint) != k {
+		t.Error("public key not found by fingerprint")
+	}
+	if kr.GetPublicKeyById(1) != nil || kr.GetPublicKeyByFingerprint([20]byte{}) != nil {
+		t.Error("expecting nil for unknown key")
+	}
+	if k, _ := kr.GetPublicKey("missing@example.com"); k != nil {
+		t.Error("expecting nil for unknown address")
+	}
+
+	sk, _ := kr.GetSecretKey("user1@example.com")
+	if sk == nil || sk.PrivateKey == nil {
+		t.Fatal("secret key not found by email address")
+	}
+	if kr.GetSecretKeyById(sk.PrimaryKey.KeyId) != sk || kr.GetSecretKeyByFingerprint(sk.PrimaryKey.Fingerprint) != sk {
+		t.Error("secret key not found by key id or fingerprint")
+	}
+	if len(kr.GetPublicKeyRing()) != len(testDataMap) || len(kr.GetSecretKeyRing()) != len(testDataMap) {
+		t.Error("key ring does not contain all keys")
+	}
+}
+
+func TestKeyRingConcurrent(t *testing.T) {
+	kr := new(KeyRing)
+	pub, _ := loadTestKeyring()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for _, k := range pub {
+				if i%2 == 0 {
+					kr.AddPublicKey(k)
+				} else {
+					kr.GetPublicKey(fmt.Sprintf("user%d@example.com", i))
+					kr.GetPublicKeyById(k.PrimaryKey.KeyId)
+					kr.GetPublicKeyRing()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, k := range pub {
+		if kr.GetPublicKeyById(k.PrimaryKey.KeyId) != k {
+			t.Error("key added concurrently not found by key id")
+		}
+	}
+}
+
+func TestKeyRingMerge(t *testing.T) {
+	kr := createTestKeyRing()
+	k, _ := kr.GetPublicKey("user1@example.com")
+	other, _ := kr.GetPublicKey("user2@example.com")
+	nsubkeys := len(k.Subkeys)
+
+	// A refreshed copy of k with an identity and subkey taken from another key
+	update := copyEntity(k)
+	for name, id := range other.Identities {
+		update.Identities[name] = id
+	}
+	update.Subkeys = append(update.Subkeys, other.Subkeys[0])
+	kr.AddPublicKey(update)
+
+	if len(kr.GetPublicKeyRing()) != len(testDataMap) {
+		t.Fatal("merged key was added as a duplicate")
+	}
+	merged := kr.GetPublicKeyByFingerprint(k.PrimaryKey.Fingerprint)
+	if merged == k || len(merged.Subkeys) != nsubkeys+1 {
+		t.Fatalf("expecting %d subkeys in merged key, got %d", nsubkeys+1, len(merged.Subkeys))
+	}
+	if len(k.Subkeys) != nsubkeys {
+		t.Error("merge changed the original key")
+	}
+	if ks, _ := kr.GetAllPublicKeys("user2@example.com"); len(ks) != 2 {
+		t.Errorf("expecting 2 keys for merged identity, got %d", len(ks))
+	}
+	if kr.GetPublicKeyById(other.Subkeys[0].PublicKey.KeyId) == nil {
+		t.Error("merged key not found by new subkey id")
+	}
+
+	// Adding it again changes nothing
+	kr.AddPublicKey(update)
+	if kr.GetPublicKeyByFingerprint(k.PrimaryKey.Fingerprint) != merged {
+		t.Error("adding an unchanged key replaced the stored key")
+	}
+}
+
+func TestKeyRingRemoveReplace(t *testing.T) {
+	kr := createTestKeyRing()
+	k, _ := kr.GetPublicKey("user1@example.com")
+	fp := k.PrimaryKey.Fingerprint
+
+	replacement := copyEntity(k)
+	replacement.Subkeys = nil
+	kr.Replace(replacement)
+	if kr.GetPublicKeyByFingerprint(fp) != replacement {
+		t.Error("public key was not replaced")
+	}
+	if kr.GetPublicKeyById(k.Subkeys[0].PublicKey.KeyId) != nil {
+		t.Error("replaced key still found by old subkey id")
+	}
+	if kr.GetSecretKeyByFingerprint(fp) == nil {
+		t.Error("secret key removed by replacing public key")
+	}
+
+	if !kr.Remove(fp) {
+		t.Fatal("expecting Remove to return true")
+	}
+	if kr.Remove(fp) {
+		t.Error("expecting Remove to return false for removed key")
+	}
+	if kr.GetPublicKeyByFingerprint(fp) != nil || kr.GetSecretKeyByFingerprint(fp) != nil {
+		t.Error("key found after removal")
+	}
+	if k, _ := kr.GetPublicKey("user1@example.com"); k != nil {
+		t.Error("removed key found by email address")
+	}
+	if len(kr.GetPublicKeyRing()) != len(testDataMap)-1 || len(kr.GetSecretKeyRing()) != len(testDataMap)-1 {
+		t.Error("expecting one key to be removed from each key ring")
+	}
+}
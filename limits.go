@@ -0,0 +1,100 @@
+package pgpmail
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Limits bounds the resources used when parsing a message so that hostile
+// input cannot exhaust memory.  A zero value for any field disables that
+// limit.
+type Limits struct {
+	// MaxHeaders is the maximum number of headers in a header block
+	MaxHeaders int
+	// MaxHeaderLineLength is the maximum length in bytes of a single
+	// header line, excluding the line ending, and of a folded header once
+	// its continuation lines are joined
+	MaxHeaderLineLength int
+	// MaxDepth is the maximum nesting depth of multipart sections and
+	// message/rfc822 parts
+	MaxDepth int
+	// MaxParts is the maximum number of multipart sections in a message
+	MaxParts int
+	// MaxDecodedSize is the maximum size in bytes of a decoded or
+	// decrypted body
+	MaxDecodedSize int
+}
+
+// DefaultLimits are the limits applied by a new Reader until they are
+// changed with SetParserLimits.
+var DefaultLimits = Limits{
+	MaxHeaders:          1000,
+	MaxHeaderLineLength: 32 * 1024,
+	MaxDepth:            32,
+	MaxParts:            1000,
+	MaxDecodedSize:      64 * 1024 * 1024,
+}
+
+// LimitExceededError is returned when a message exceeds one of the
+// configured Limits.  A Lenient Reader does not recover from it.
+type LimitExceededError struct {
+	// Limit is the name of the Limits field which was exceeded
+	Limit string
+	// Max is the value of the limit
+	Max int
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("message exceeds parser limit %s of %d", e.Limit, e.Max)
+}
+
+// checkLimit returns a LimitExceededError if max is set and n exceeds it.
+func checkLimit(name string, max, n int) error {
+	if max > 0 && n > max {
+		return &LimitExceededError{Limit: name, Max: max}
+	}
+	return nil
+}
+
+// readLimited reads all of r, returning a LimitExceededError if more than
+// MaxDecodedSize bytes are available.
+func (l Limits) readLimited(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(l.limitReader(r))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// limitReader returns a reader for r which fails with a LimitExceededError
+// once more than MaxDecodedSize bytes have been read.
+func (l Limits) limitReader(r io.Reader) io.Reader {
+	if l.MaxDecodedSize <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, max: l.MaxDecodedSize}
+}
+
+type limitedReader struct {
+	r        io.Reader
+	max, n   int
+	exceeded bool
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.exceeded {
+		return 0, &LimitExceededError{Limit: "MaxDecodedSize", Max: lr.max}
+	}
+	// Read one byte more than the limit allows to detect when it is exceeded
+	if len(p) > lr.max-lr.n+1 {
+		p = p[:lr.max-lr.n+1]
+	}
+	n, err := lr.r.Read(p)
+	lr.n += n
+	if lr.n > lr.max {
+		lr.exceeded = true
+		return n - (lr.n - lr.max), &LimitExceededError{Limit: "MaxDecodedSize", Max: lr.max}
+	}
+	return n, err
+}
@@ -0,0 +1,123 @@
+package pgpmail
+
+import (
+	"strings"
+	"testing"
+)
+
+func readWithLimits(msg string, limits Limits, lenient bool) error {
+	r := NewReader(msg)
+	r.Limits = limits
+	r.Lenient = lenient
+	_, err := r.ReadMessage()
+	return err
+}
+
+func expectLimitError(t *testing.T, err error, limit string) {
+	e, ok := err.(*LimitExceededError)
+	if !ok {
+		t.Errorf("expecting LimitExceededError for %s, got: %v", limit, err)
+		return
+	}
+	if e.Limit != limit {
+		t.Errorf("expecting %s to be exceeded, got %s", limit, e.Limit)
+	}
+}
+
+func TestLimitHeaders(t *testing.T) {
+	td := new(TestData)
+	td.Body = "Hello"
+	msg := td.String()
+	if err := readWithLimits(msg, Limits{MaxHeaders: 10}, false); err != nil {
+		t.Fatal("unexpected error reading message: " + err.Error())
+	}
+	expectLimitError(t, readWithLimits(msg, Limits{MaxHeaders: 3}, false), "MaxHeaders")
+
+	long := "Subject: " + strings.Repeat("x", 5000) + "\r\n\r\nbody"
+	expectLimitError(t, readWithLimits(long, Limits{MaxHeaderLineLength: 1000}, false), "MaxHeaderLineLength")
+	folded := "Subject: x\r\n " + strings.Repeat("x", 5000) + "\r\n\r\nbody"
+	expectLimitError(t, readWithLimits(folded, Limits{MaxHeaderLineLength: 1000}, false), "MaxHeaderLineLength")
+	// Short continuation lines must not get around the limit
+	manyLines := "Subject: x" + strings.Repeat("\r\n xxxxxxxx", 200) + "\r\n\r\nbody"
+	if err := readWithLimits(manyLines, Limits{MaxHeaderLineLength: 5000}, false); err != nil {
+		t.Fatal("unexpected error reading folded header: " + err.Error())
+	}
+	expectLimitError(t, readWithLimits(manyLines, Limits{MaxHeaderLineLength: 1000}, false), "MaxHeaderLineLength")
+	expectLimitError(t, readWithLimits(manyLines, Limits{MaxHeaderLineLength: 1000}, true), "MaxHeaderLineLength")
+}
+
+func TestLimitParts(t *testing.T) {
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{nestedAlternativePart, plainPart}
+	msg := td.String()
+	if err := readWithLimits(msg, Limits{MaxDepth: 2, MaxParts: 4}, false); err != nil {
+		t.Fatal("unexpected error reading message: " + err.Error())
+	}
+	expectLimitError(t, readWithLimits(msg, Limits{MaxDepth: 1}, false), "MaxDepth")
+	expectLimitError(t, readWithLimits(msg, Limits{MaxParts: 3}, false), "MaxParts")
+	// Limits are not relaxed by a lenient Reader
+	expectLimitError(t, readWithLimits(msg, Limits{MaxParts: 3}, true), "MaxParts")
+}
+
+func TestLimitDecodedSize(t *testing.T) {
+	defer SetParserLimits(DefaultLimits)
+	SetParserLimits(Limits{MaxDecodedSize: 10})
+
+	p := new(MessagePart)
+	p.Body = strings.Repeat("x", 11)
+	_, err := p.DecodedBody()
+	expectLimitError(t, err, "MaxDecodedSize")
+
+	p.SetHeader("Content-Transfer-Encoding", "quoted-printable")
+	_, err = p.DecodedBody()
+	expectLimitError(t, err, "MaxDecodedSize")
+
+	p.SetHeader("Content-Transfer-Encoding", "base64")
+	p.Body = "eHh4eHh4\r\neHh4eHh4\r\n"
+	_, err = p.DecodedBody()
+	expectLimitError(t, err, "MaxDecodedSize")
+}
+
+func TestLimitEmbeddedDepth(t *testing.T) {
+	msg := "Subject: Innermost\r\n\r\nHello"
+	for i := 0; i < 1000; i++ {
+		msg = "Content-Type: message/rfc822\r\n\r\n" + msg
+	}
+	m, err := ParseMessage(msg)
+	if err != nil {
+		t.Fatal("error parsing nested message: " + err.Error())
+	}
+	p, depth := &m.MessagePart, 0
+	for {
+		em, err := p.EmbeddedMessage()
+		if err != nil {
+			expectLimitError(t, err, "MaxDepth")
+			break
+		}
+		p = &em.MessagePart
+		depth++
+	}
+	if depth != DefaultLimits.MaxDepth {
+		t.Errorf("expecting %d embedded messages to be parsed, got %d", DefaultLimits.MaxDepth, depth)
+	}
+
+	SetProcessEmbeddedMessages(true)
+	defer SetProcessEmbeddedMessages(false)
+	m, _ = ParseMessage(msg)
+	ds := m.Decrypt(testKeys)
+	for depth = 0; len(ds.Embedded) == 1; depth++ {
+		ds = ds.Embedded[0]
+	}
+	if depth != DefaultLimits.MaxDepth+1 || !strings.Contains(ds.FailureMessage, "MaxDepth") {
+		t.Errorf("expecting decryption to stop at MaxDepth, stopped at %d: %s", depth, ds.FailureMessage)
+	}
+	m, _ = ParseMessage(msg)
+	vs := m.Verify(testKeys)
+	for depth = 0; len(vs.Embedded) == 1; depth++ {
+		vs = vs.Embedded[0]
+	}
+	if depth != DefaultLimits.MaxDepth+1 || !strings.Contains(vs.FailureMessage, "MaxDepth") {
+		t.Errorf("expecting verification to stop at MaxDepth, stopped at %d: %s", depth, vs.FailureMessage)
+	}
+}
@@ -0,0 +1,261 @@
+// Package maildir runs pgpmail operations over every message of a Maildir,
+// replacing processed messages atomically and reporting the status of each.
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nymsio/pgpmail"
+)
+
+// A Result reports the outcome of processing one message file.
+type Result struct {
+	// Path is the name of the message file relative to the Maildir, for
+	// example "cur/1420070400.M1P2.host:2,S"
+	Path string
+	// The status of each operation applied to the message, or nil if the
+	// operation was not applied
+	Decrypt *pgpmail.DecryptionStatus
+	Verify  *pgpmail.VerifyStatus
+	Encrypt *pgpmail.EncryptStatus
+	// Written is true if the message file was replaced with the result
+	Written bool
+	// Err is set if the message could not be read, parsed or written
+	Err error
+}
+
+// A Processor applies pgpmail operations to the messages in the cur and
+// new directories of a Maildir.  Changed messages are written to tmp and
+// then renamed over the original file, so the Maildir flags in the file
+// name are kept.
+type Processor struct {
+	// Dir is the Maildir containing the cur, new and tmp directories
+	Dir        string
+	KeySource  pgpmail.KeySource
+	Passphrase []byte
+	// Options are the settings used for each operation, or nil for the
+	// pgpmail defaults
+	Options *pgpmail.Options
+}
+
+// process is applied to each message and returns true if the message
+// should be written back.
+type process func(m *pgpmail.Message, r *Result) bool
+
+// Decrypt decrypts every encrypted message and replaces it with the
+// plaintext.
+func (p *Processor) Decrypt() ([]*Result, error) {
+	return p.run(p.decrypt)
+}
+
+// Verify checks the signature of every message.  Messages are not
+// changed.
+func (p *Processor) Verify() ([]*Result, error) {
+	return p.run(func(m *pgpmail.Message, r *Result) bool {
+		r.Verify = pgpmail.NewProcessor(p.Options).Verify(m, p.KeySource)
+		return false
+	})
+}
+
+// Encrypt encrypts every message which is not already encrypted, either as
+// PGP/MIME or with inline PGP, to its recipients.
+func (p *Processor) Encrypt() ([]*Result, error) {
+	return p.run(p.encrypt)
+}
+
+// Reencrypt decrypts every encrypted message and encrypts it again to the
+// keys currently available for its recipients.  Messages which are not
+// encrypted or which fail to decrypt are left unchanged.
+func (p *Processor) Reencrypt() ([]*Result, error) {
+	return p.run(func(m *pgpmail.Message, r *Result) bool {
+		if !p.decrypt(m, r) {
+			return false
+		}
+		return p.encrypt(m, r)
+	})
+}
+
+func (p *Processor) decrypt(m *pgpmail.Message, r *Result) bool {
+	r.Decrypt = pgpmail.NewProcessor(p.Options).DecryptWith(m, p.KeySource, p.Passphrase)
+	return r.Decrypt.Code == pgpmail.DecryptSuccess
+}
+
+func (p *Processor) encrypt(m *pgpmail.Message, r *Result) bool {
+	proc := pgpmail.NewProcessor(p.Options)
+	if isEncrypted(proc, m) {
+		return false
+	}
+	r.Encrypt = proc.Encrypt(m, p.KeySource)
+	return r.Encrypt.Code == pgpmail.StatusEncryptedOnly
+}
+
+// isEncrypted returns true if m is a PGP/MIME encrypted message or if any
+// part of it holds an inline PGP message.  Parts are decoded applying the
+// limits of proc.
+func isEncrypted(proc *pgpmail.Processor, m *pgpmail.Message) bool {
+	if m.MediaType() == "multipart/encrypted" {
+		return true
+	}
+	found := false
+	m.Walk(func(path []int, p *pgpmail.MessagePart) error {
+		if found || p.IsMultipart() {
+			return nil
+		}
+		if body, err := proc.DecodedBody(p); err == nil && hasInlineMessage(string(body)) {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
+
+// hasInlineMessage returns true if a line of text starts an armored PGP
+// message.
+func hasInlineMessage(text string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, "-----BEGIN PGP MESSAGE-----") {
+			return true
+		}
+	}
+	return false
+}
+
+// run applies fn to each message of cur and then of new.
+func (p *Processor) run(fn process) ([]*Result, error) {
+	if _, err := os.Stat(filepath.Join(p.Dir, "tmp")); err != nil {
+		return nil, errors.New("not a maildir: " + err.Error())
+	}
+	var results []*Result
+	for _, sub := range []string{"cur", "new"} {
+		fis, err := ioutil.ReadDir(filepath.Join(p.Dir, sub))
+		if err != nil {
+			return results, err
+		}
+		for _, fi := range fis {
+			if !fi.Mode().IsRegular() || fi.Name()[0] == '.' {
+				continue
+			}
+			results = append(results, p.processFile(filepath.Join(sub, fi.Name()), fn))
+		}
+	}
+	return results, nil
+}
+
+func (p *Processor) processFile(path string, fn process) *Result {
+	r := &Result{Path: path}
+	data, err := ioutil.ReadFile(filepath.Join(p.Dir, path))
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	m, err := p.parse(data)
+	if err != nil {
+		r.Err = errors.New("error parsing message: " + err.Error())
+		return r
+	}
+	if !fn(m, r) {
+		return r
+	}
+	newPath, err := p.replace(path, []byte(m.String()))
+	if newPath != "" {
+		r.Path = newPath
+		r.Written = true
+	}
+	if err != nil {
+		r.Err = errors.New("error writing message: " + err.Error())
+	}
+	return r
+}
+
+// parse parses a message leniently, as ParseMessage does, with the limits
+// of the Options of p.
+func (p *Processor) parse(data []byte) (*pgpmail.Message, error) {
+	r := pgpmail.NewReader(string(data))
+	r.Lenient = true
+	if p.Options != nil {
+		r.Limits = p.Options.Limits
+	}
+	return r.ReadMessage()
+}
+
+// replace writes data to a new file in tmp and renames it over the message
+// file at path.  If the file name records the message size, the file is
+// then renamed to update the size, so that the message is never listed
+// twice.  The path of the message is returned, along with an error if the
+// message was written but could not be renamed.  An empty path is
+// returned if the message was not replaced.
+func (p *Processor) replace(path string, data []byte) (string, error) {
+	tmp := filepath.Join(p.Dir, "tmp", uniqueName())
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, filepath.Join(p.Dir, path)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	newPath := filepath.Join(filepath.Dir(path), setSize(filepath.Base(path), len(data)))
+	if newPath != path {
+		if err := os.Rename(filepath.Join(p.Dir, path), filepath.Join(p.Dir, newPath)); err != nil {
+			return path, errors.New("message size in file name not updated: " + err.Error())
+		}
+	}
+	return newPath, nil
+}
+
+var sizeField = regexp.MustCompile(`,S=[0-9]+`)
+
+// setSize updates the ",S=" message size field which some delivery agents
+// add to the unique part of a file name, before the ":2," flags.
+func setSize(name string, size int) string {
+	unique, info := name, ""
+	if idx := strings.LastIndex(name, ":"); idx != -1 {
+		unique, info = name[:idx], name[idx:]
+	}
+	if !sizeField.MatchString(unique) {
+		return name
+	}
+	return sizeField.ReplaceAllLiteralString(unique, ",S="+strconv.Itoa(size)) + info
+}
+
+var deliveries uint64
+
+// hostnameReplacer escapes the characters of a host name which cannot
+// appear in a Maildir file name, as described by the Maildir specification.
+var hostnameReplacer = strings.NewReplacer("/", `\057`, ":", `\072`)
+
+// uniqueName returns a name for a file in tmp in the usual Maildir form of
+// time, delivery identifier and host name.
+func uniqueName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = hostnameReplacer.Replace(host)
+	now := time.Now()
+	n := atomic.AddUint64(&deliveries, 1)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, host)
+}
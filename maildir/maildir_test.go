@@ -0,0 +1,198 @@
+package maildir
+
+import (
+	"crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+	"github.com/nymsio/pgpmail"
+)
+
+const testMessage = "From: user@example.com\r\nTo: user@example.com\r\nSubject: Test\r\n\r\nHello, World\r\n"
+
+func createMaildir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func createKeySource(t *testing.T) pgpmail.KeySource {
+	config := &packet.Config{DefaultHash: crypto.SHA256}
+	e, err := openpgp.NewEntity("Test User", "", "user@example.com", config)
+	if err != nil {
+		t.Fatal("error generating key: " + err.Error())
+	}
+	kr := new(pgpmail.KeyRing)
+	kr.AddPublicKey(e)
+	kr.AddSecretKey(e)
+	return kr
+}
+
+func readMessage(t *testing.T, dir, path string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	dir := createMaildir(t, map[string]string{
+		"cur/1420070400.M1P1.host,S=83:2,RS": testMessage,
+		"new/1420070401.M1P1.host":           testMessage,
+	})
+	defer os.RemoveAll(dir)
+	p := &Processor{Dir: dir, KeySource: createKeySource(t)}
+
+	results, err := p.Encrypt()
+	if err != nil {
+		t.Fatal("error encrypting maildir: " + err.Error())
+	}
+	if len(results) != 2 {
+		t.Fatalf("expecting 2 results, got %d", len(results))
+	}
+	for _, r := range results {
+		if r.Err != nil || !r.Written || r.Encrypt.Code != pgpmail.StatusEncryptedOnly {
+			t.Fatalf("message %s not encrypted: %v %v", r.Path, r.Err, r.Encrypt)
+		}
+		if !strings.Contains(readMessage(t, dir, r.Path), "-----BEGIN PGP MESSAGE-----") {
+			t.Errorf("encrypted message not written to %s", r.Path)
+		}
+	}
+	if !strings.HasPrefix(results[0].Path, "cur/1420070400.M1P1.host,S=") || !strings.HasSuffix(results[0].Path, ":2,RS") {
+		t.Errorf("unexpected file name for encrypted message: %s", results[0].Path)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cur/1420070400.M1P1.host,S=83:2,RS")); !os.IsNotExist(err) {
+		t.Error("message with outdated size remains in maildir")
+	}
+	if fis, _ := ioutil.ReadDir(filepath.Join(dir, "tmp")); len(fis) != 0 {
+		t.Error("files left in tmp")
+	}
+
+	// Already encrypted messages are not encrypted again
+	results, _ = p.Encrypt()
+	if results[0].Written || results[0].Encrypt != nil {
+		t.Error("encrypted message was encrypted again")
+	}
+
+	results, err = p.Decrypt()
+	if err != nil {
+		t.Fatal("error decrypting maildir: " + err.Error())
+	}
+	for _, r := range results {
+		if r.Err != nil || !r.Written || r.Decrypt.Code != pgpmail.DecryptSuccess {
+			t.Fatalf("message %s not decrypted: %v %v", r.Path, r.Err, r.Decrypt)
+		}
+		if !strings.Contains(readMessage(t, dir, r.Path), "Hello, World") {
+			t.Errorf("decrypted message not written to %s", r.Path)
+		}
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	dir := createMaildir(t, map[string]string{"cur/1420070400.M1P1.host:2,S": testMessage})
+	defer os.RemoveAll(dir)
+	p := &Processor{Dir: dir, KeySource: createKeySource(t)}
+
+	// Messages which are not encrypted are left alone
+	results, err := p.Reencrypt()
+	if err != nil {
+		t.Fatal("error re-encrypting maildir: " + err.Error())
+	}
+	if len(results) != 1 || results[0].Written || results[0].Encrypt != nil ||
+		results[0].Decrypt.Code != pgpmail.DecryptNotEncrypted {
+		t.Errorf("message which was not encrypted was re-encrypted: %v", results)
+	}
+	if readMessage(t, dir, "cur/1420070400.M1P1.host:2,S") != testMessage {
+		t.Error("message which was not encrypted was changed")
+	}
+
+	if _, err := p.Encrypt(); err != nil {
+		t.Fatal("error encrypting maildir: " + err.Error())
+	}
+	results, err = p.Reencrypt()
+	if err != nil {
+		t.Fatal("error re-encrypting maildir: " + err.Error())
+	}
+	if len(results) != 1 || !results[0].Written || results[0].Decrypt.Code != pgpmail.DecryptSuccess ||
+		results[0].Encrypt == nil || results[0].Encrypt.Code != pgpmail.StatusEncryptedOnly {
+		t.Errorf("encrypted message not re-encrypted: %v", results)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := createMaildir(t, map[string]string{"cur/1420070400.M1P1.host:2,S": testMessage})
+	defer os.RemoveAll(dir)
+	p := &Processor{Dir: dir, KeySource: new(pgpmail.KeyRing)}
+
+	results, err := p.Verify()
+	if err != nil {
+		t.Fatal("error verifying maildir: " + err.Error())
+	}
+	if len(results) != 1 || results[0].Verify.Code != pgpmail.VerifyNotSigned || results[0].Written {
+		t.Errorf("unexpected verify results: %v", results)
+	}
+	if readMessage(t, dir, "cur/1420070400.M1P1.host:2,S") != testMessage {
+		t.Error("verified message was changed")
+	}
+
+	if _, err := (&Processor{Dir: filepath.Join(dir, "cur")}).Verify(); err == nil {
+		t.Error("expecting error processing directory which is not a maildir")
+	}
+}
+
+func TestEncryptSkipsInline(t *testing.T) {
+	inline := "From: user@example.com\r\nTo: user@example.com\r\nSubject: Inline\r\n\r\n" +
+		"-----BEGIN PGP MESSAGE-----\r\n\r\nhQEMA0AAAAAAAAAAAQf/\r\n-----END PGP MESSAGE-----\r\n"
+	dir := createMaildir(t, map[string]string{"cur/1420070400.M1P1.host:2,S": inline})
+	defer os.RemoveAll(dir)
+	p := &Processor{Dir: dir, KeySource: createKeySource(t)}
+
+	results, err := p.Encrypt()
+	if err != nil {
+		t.Fatal("error encrypting maildir: " + err.Error())
+	}
+	if len(results) != 1 || results[0].Written || results[0].Encrypt != nil {
+		t.Error("inline encrypted message was encrypted again")
+	}
+	if readMessage(t, dir, "cur/1420070400.M1P1.host:2,S") != inline {
+		t.Error("inline encrypted message was changed")
+	}
+
+	// Parts are decoded with the limits of the Options
+	m, err := pgpmail.ParseMessage(inline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := pgpmail.DefaultOptions()
+	opts.Limits.MaxDecodedSize = 10
+	if isEncrypted(pgpmail.NewProcessor(opts), m) {
+		t.Error("limits of Options not applied when looking for inline PGP")
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	if h := hostnameReplacer.Replace("host/name:1"); h != `host\057name\0721` {
+		t.Errorf("host name not escaped: %s", h)
+	}
+	if name := uniqueName(); strings.ContainsAny(name, "/:") {
+		t.Errorf("unique name contains reserved characters: %s", name)
+	}
+}
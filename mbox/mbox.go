@@ -0,0 +1,212 @@
+// Package mbox reads and writes mailbox files in the mbox format so that
+// the messages of an archive can be decrypted or verified with pgpmail in
+// a single pass.
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/nymsio/pgpmail"
+)
+
+// Format selects how lines of a message body which would be mistaken for
+// a "From " separator line are escaped.
+type Format int
+
+const (
+	// MBOXO escapes lines beginning with "From " by adding a '>'.  The
+	// escaping cannot be reversed, so a Reader leaves such lines quoted.
+	MBOXO Format = iota
+	// MBOXRD adds a '>' to lines beginning with any number of '>'
+	// followed by "From ", and a Reader removes it again.
+	MBOXRD
+)
+
+var fromPrefix = []byte("From ")
+
+// An Entry is a message from a mailbox along with its separator line.
+type Entry struct {
+	// Envelope is the remainder of the "From " separator line, usually
+	// the envelope sender and the delivery date
+	Envelope string
+	// Message is the parsed message, or nil if it could not be parsed
+	Message *pgpmail.Message
+	// Raw holds the unescaped text of the message as read from the mailbox
+	Raw string
+}
+
+// A Reader iterates over the messages of a mailbox.
+type Reader struct {
+	r      *bufio.Reader
+	format Format
+	// separator is the "From " line which begins the next message
+	separator []byte
+	err       error
+}
+
+// NewReader returns a Reader which reads messages in the given format
+// from r.
+func NewReader(r io.Reader, format Format) *Reader {
+	return &Reader{r: bufio.NewReader(r), format: format}
+}
+
+// Next returns the next message of the mailbox, or io.EOF when there are
+// no more messages.  If a message cannot be parsed the Entry is returned
+// with a nil Message along with the error, and Next may be called again to
+// continue with the following message.
+func (r *Reader) Next() (*Entry, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.separator == nil {
+		if err := r.readFirstSeparator(); err != nil {
+			r.err = err
+			return nil, err
+		}
+	}
+	e := &Entry{Envelope: envelope(r.separator)}
+	r.separator = nil
+	body := new(bytes.Buffer)
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if bytes.HasPrefix(line, fromPrefix) {
+			r.separator = line
+			break
+		}
+		body.Write(r.unescape(line))
+		if err == io.EOF {
+			r.err = io.EOF
+			break
+		} else if err != nil {
+			r.err = err
+			return nil, err
+		}
+	}
+	e.Raw = string(trimSeparatorLine(body.Bytes()))
+	m, err := pgpmail.ParseMessage(e.Raw)
+	if err != nil {
+		return e, errors.New("mbox: error parsing message: " + err.Error())
+	}
+	e.Message = m
+	return e, nil
+}
+
+// readFirstSeparator skips blank lines at the start of the mailbox and
+// reads the first "From " line.
+func (r *Reader) readFirstSeparator() error {
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if bytes.HasPrefix(line, fromPrefix) {
+			r.separator = line
+			return nil
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			return errors.New("mbox: mailbox does not begin with a From line")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Reader) unescape(line []byte) []byte {
+	if r.format == MBOXRD && isQuotedFromLine(line) {
+		return line[1:]
+	}
+	return line
+}
+
+// envelope returns the text of a separator line after "From " without the
+// line ending.
+func envelope(separator []byte) string {
+	return string(bytes.TrimRight(separator[len(fromPrefix):], "\r\n"))
+}
+
+// trimSeparatorLine removes the blank line which precedes the next
+// separator from the end of a message.
+func trimSeparatorLine(msg []byte) []byte {
+	if bytes.HasSuffix(msg, []byte("\r\n\r\n")) {
+		return msg[:len(msg)-2]
+	}
+	if bytes.HasSuffix(msg, []byte("\n\n")) {
+		return msg[:len(msg)-1]
+	}
+	return msg
+}
+
+// isQuotedFromLine returns true if line is one or more '>' followed by
+// "From ".
+func isQuotedFromLine(line []byte) bool {
+	quoted := bytes.TrimLeft(line, ">")
+	return len(quoted) < len(line) && bytes.HasPrefix(quoted, fromPrefix)
+}
+
+// A Writer writes messages to a mailbox.
+type Writer struct {
+	w      io.Writer
+	format Format
+}
+
+// NewWriter returns a Writer which writes messages in the given format to
+// w.
+func NewWriter(w io.Writer, format Format) *Writer {
+	return &Writer{w: w, format: format}
+}
+
+// Write appends the message of e to the mailbox, or the Raw text if the
+// Message is nil.  If e has no Envelope a separator line with the sender
+// MAILER-DAEMON and the current time is written.
+func (w *Writer) Write(e *Entry) error {
+	text := e.Raw
+	if e.Message != nil {
+		text = e.Message.String()
+	}
+	env := e.Envelope
+	if env == "" {
+		env = "MAILER-DAEMON " + time.Now().UTC().Format(time.ANSIC)
+	}
+	eol := lineEnding(text)
+
+	b := new(bytes.Buffer)
+	b.Write(fromPrefix)
+	b.WriteString(env)
+	b.WriteString(eol)
+	for len(text) > 0 {
+		line := text
+		if idx := strings.IndexByte(text, '\n'); idx != -1 {
+			line = text[:idx+1]
+		}
+		text = text[len(line):]
+		if w.escape([]byte(line)) {
+			b.WriteByte('>')
+		}
+		b.WriteString(line)
+	}
+	if b.Len() > 0 && b.Bytes()[b.Len()-1] != '\n' {
+		b.WriteString(eol)
+	}
+	b.WriteString(eol)
+	_, err := w.w.Write(b.Bytes())
+	return err
+}
+
+func (w *Writer) escape(line []byte) bool {
+	if bytes.HasPrefix(line, fromPrefix) {
+		return true
+	}
+	return w.format == MBOXRD && isQuotedFromLine(line)
+}
+
+// lineEnding returns the line ending used by the first line of text.
+func lineEnding(text string) string {
+	idx := strings.IndexByte(text, '\n')
+	if idx > 0 && text[idx-1] == '\r' {
+		return "\r\n"
+	}
+	return "\n"
+}
@@ -0,0 +1,100 @@
+package mbox
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+var testMboxrd = `From alice@example.com Thu Jan  1 00:00:00 2015
+From: alice@example.com
+To: bob@example.com
+Subject: First
+
+>From the start of a line.
+>>From a quoted line.
+
+From bob@example.com Fri Jan  2 00:00:00 2015
+From: bob@example.com
+To: alice@example.com
+Subject: Second
+
+Second body.
+
+`
+
+func readAll(t *testing.T, r *Reader) []*Entry {
+	var es []*Entry
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return es
+		}
+		if err != nil {
+			t.Fatal("error reading mailbox: " + err.Error())
+		}
+		es = append(es, e)
+	}
+}
+
+func TestReadMboxrd(t *testing.T) {
+	es := readAll(t, NewReader(strings.NewReader(testMboxrd), MBOXRD))
+	if len(es) != 2 {
+		t.Fatalf("expecting 2 messages, got %d", len(es))
+	}
+	if es[0].Envelope != "alice@example.com Thu Jan  1 00:00:00 2015" {
+		t.Errorf("unexpected envelope: %q", es[0].Envelope)
+	}
+	if s := es[0].Message.GetHeaderValue("Subject"); s != "First" {
+		t.Errorf("unexpected subject of first message: %q", s)
+	}
+	if b := es[0].Message.Body; b != "From the start of a line.\n>From a quoted line.\n" {
+		t.Errorf("first message body not unescaped: %q", b)
+	}
+	if b := es[1].Message.Body; b != "Second body.\n" {
+		t.Errorf("unexpected body of second message: %q", b)
+	}
+}
+
+func TestReadMboxo(t *testing.T) {
+	es := readAll(t, NewReader(strings.NewReader(testMboxrd), MBOXO))
+	if len(es) != 2 {
+		t.Fatalf("expecting 2 messages, got %d", len(es))
+	}
+	if b := es[0].Message.Body; b != ">From the start of a line.\n>>From a quoted line.\n" {
+		t.Errorf("mboxo body should not be unescaped: %q", b)
+	}
+}
+
+func TestWriteMboxrd(t *testing.T) {
+	es := readAll(t, NewReader(strings.NewReader(testMboxrd), MBOXRD))
+	out := new(bytes.Buffer)
+	w := NewWriter(out, MBOXRD)
+	for _, e := range es {
+		if err := w.Write(e); err != nil {
+			t.Fatal("error writing mailbox: " + err.Error())
+		}
+	}
+	if out.String() != testMboxrd {
+		t.Errorf("mailbox does not match original:\n%s", out.String())
+	}
+
+	out.Reset()
+	w = NewWriter(out, MBOXO)
+	w.Write(es[0])
+	if !strings.Contains(out.String(), "\n>From the start of a line.\n>From a quoted line.\n") {
+		t.Errorf("message not escaped as mboxo:\n%s", out.String())
+	}
+}
+
+func TestReadNotMbox(t *testing.T) {
+	r := NewReader(strings.NewReader("Subject: not a mailbox\n\nbody\n"), MBOXRD)
+	if _, err := r.Next(); err == nil || err == io.EOF {
+		t.Errorf("expecting error reading text which is not a mailbox, got %v", err)
+	}
+	r = NewReader(strings.NewReader(""), MBOXRD)
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("expecting io.EOF for empty mailbox, got %v", err)
+	}
+}
@@ -6,50 +6,119 @@ import (
 )
 
 var crlf = []byte("\r\n")
+var lf = []byte("\n")
 
 type Header struct {
 	Name  string
 	Value string
+	// encode is set for headers added with AddEncodedHeader or
+	// SetEncodedHeader, which hold an unencoded value that is encoded
+	// and folded when the header is rendered.
+	encode bool
+	// raw is set for headers read from a message
+	raw *rawHeader
+}
+
+// rawHeader holds the text of a header exactly as it was read, including
+// any folding and the line ending, along with the parsed name and value so
+// that changes to the header can be detected.
+type rawHeader struct {
+	name  string
+	value string
+	text  string
+}
+
+// isModified returns true if h must be rendered rather than written as
+// the text it was read from.
+func (h *Header) isModified() bool {
+	return h.raw == nil || h.encode || h.raw.name != h.Name || h.raw.value != h.Value
 }
 
 func (h Header) String() string {
+	if h.encode {
+		return encodeHeader(h.Name, h.Value, crlf)
+	}
 	return fmt.Sprintf("%s: %s", h.Name, h.Value)
 }
 
 // A MessagePart represents either an entire message or a multipart section.
+// A multipart section may itself be multipart, in which case its own
+// sections are available from Parts.
 type MessagePart struct {
 	rawContent []byte
 	// HeaderList contains Header values in the order in which they appear in the message
-	HeaderList []*Header
-	Body       string
-}
-
-type Message struct {
-	MessagePart
+	HeaderList  []*Header
+	Body        string
 	ctPrimary   string
 	ctSecondary string
 	ctParams    map[string]string
 	mpContent   *multipartContent
+	// headerEnd holds the blank line which ended the header block of a
+	// parsed message part
+	headerEnd string
+	// boundaryPadding holds the transport padding and line ending which
+	// followed the delimiter preceding a parsed multipart section
+	boundaryPadding []byte
+	// boundaryEOL holds the line ending which preceded the delimiter
+	// following a parsed multipart section.  It is empty rather than nil if
+	// the delimiter was not preceded by a line ending.
+	boundaryEOL []byte
+	// embedded is the parsed body of a message/rfc822 part
+	embedded *Message
+	// depth is the number of multipart sections and embedded messages
+	// enclosing a parsed part
+	depth int
+	// headerless is set for a multipart section recovered by a lenient
+	// Reader which had no header block, so that only its body is rendered
+	headerless bool
 }
 
+type Message struct {
+	MessagePart
+}
+
+// ParseMessage parses msg with a Lenient Reader, so that what can be found
+// of the structure of a malformed multipart message is returned rather than
+// an error.  Use a Reader directly to have such problems reported.
 func ParseMessage(msg string) (*Message, error) {
-	return NewReader(msg).ReadMessage()
+	r := NewReader(msg)
+	r.Lenient = true
+	return r.ReadMessage()
 }
 
+// String renders the message part.  Headers of a parsed message which have
+// not been changed are written exactly as they were read.
 func (m *MessagePart) String() string {
 	b := new(bytes.Buffer)
 	for _, h := range m.HeaderList {
-		b.WriteString(h.String())
+		if !h.isModified() {
+			b.WriteString(h.raw.text)
+			continue
+		}
+		b.WriteString(h.render(m.lineEnding()))
+		b.Write(m.lineEnding())
+	}
+	if m.headerEnd != "" {
+		b.WriteString(m.headerEnd)
+	} else if !m.headerless || len(m.HeaderList) > 0 {
 		b.Write(crlf)
 	}
-	b.Write(crlf)
 	b.WriteString(m.Body)
 	return b.String()
 }
 
+// lineEnding returns the line ending used by the header of m, which is
+// CRLF unless m was parsed from a message using bare LF line endings.
+func (m *MessagePart) lineEnding() []byte {
+	if m.headerEnd == "\n" {
+		return lf
+	}
+	return crlf
+}
+
 func (m *MessagePart) AddHeader(name, value string) {
 	key := CanonicalMIMEHeaderKey(name)
-	m.HeaderList = append(m.HeaderList, &Header{key, value})
+	m.HeaderList = append(m.HeaderList, &Header{Name: key, Value: value})
 }
 
 func (m *MessagePart) SetHeader(name, value string) {
@@ -1,6 +1,9 @@
 package pgpmail
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestAddHeader(t *testing.T) {
 	m := new(Message)
@@ -41,3 +44,58 @@ func TestTemplates(t *testing.T) {
 		t.Error("parsed multipart did not match original body")
 	}
 }
+
+var roundTripMessage = insertCR(`from: Sender <from@example.com>
+To:   to@example.com,
+	alice@example.com  
+Subject: A folded
+  subject line
+X-Odd-Spacing :value
+Content-Type: multipart/mixed;
+ boundary="rt-boundary"
+
+This is the preamble.
+
+--rt-boundary
+content-type: text/plain;   charset="us-ascii"
+
+First part.
+--rt-boundary
+Content-Type: text/plain
+X-Folded: one
+ two
+
+Second part.
+
+--rt-boundary--
+`)
+
+func TestRoundTrip(t *testing.T) {
+	m, err := ParseMessage(roundTripMessage)
+	if err != nil {
+		t.Fatal("error parsing message: " + err.Error())
+	}
+	if m.String() != roundTripMessage {
+		t.Error("parsed message does not render to original text")
+	}
+	if m.GetHeaderValue("Subject") != "A folded subject line" {
+		t.Errorf("folded header not unfolded: %q", m.GetHeaderValue("Subject"))
+	}
+	if err := m.PackMultiparts(); err != nil {
+		t.Fatal("error packing multiparts: " + err.Error())
+	}
+	if m.String() != roundTripMessage {
+		t.Error("packing unmodified multiparts changed message text")
+	}
+
+	m.Parts()[0].Body = "Modified part."
+	m.Parts()[0].SetHeader("X-Added", "yes")
+	m.PackMultiparts()
+	m.SetHeader("Subject", "Replaced")
+	expected := strings.Replace(roundTripMessage, "First part.", "Modified part.", 1)
+	expected = strings.Replace(expected, "charset=\"us-ascii\"\r\n", "charset=\"us-ascii\"\r\nX-Added: yes\r\n", 1)
+	expected = strings.Replace(expected, "Subject: A folded\r\n  subject line", "Subject: Replaced", 1)
+	if m.String() != expected {
+		t.Errorf("modified message does not match expected text:\n%s", m.String())
+	}
+}
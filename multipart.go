@@ -1,23 +1,44 @@
 package pgpmail
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
-func (m *Message) IsMultipart() bool {
+func (m *MessagePart) IsMultipart() bool {
 	return m.ctPrimary == "multipart"
 }
 
 var malformed = errors.New("malformed mime body")
 
 type multipartContent struct {
+	// preamble is the text before the line ending which precedes the first
+	// delimiter, or nil if the body begins with the delimiter
 	preamble []byte
-	boundary []byte
-	parts    []*MessagePart
+	// preambleEOL is the line ending which followed a parsed preamble
+	preambleEOL []byte
+	boundary    []byte
+	// eol is the line ending used for delimiters without a recorded line
+	// ending
+	eol   []byte
+	parts []*MessagePart
+	// epilogue is the text following the closing delimiter, including the
+	// line ending of the delimiter, and is empty rather than nil for a
+	// parsed part where nothing follows the delimiter.  If it is nil a line
+	// ending is written after the closing delimiter unless the part is
+	// nested.
+	epilogue []byte
+	// unclosed is set for a part recovered by a lenient Reader which had no
+	// closing delimiter, so that none is written.  trailer holds the text
+	// which followed the line ending of the last section, such as a
+	// truncated delimiter.
+	unclosed bool
+	trailer  []byte
 }
 
 type extractState struct {
@@ -30,10 +51,15 @@ type extractState struct {
 
 var dashes = []byte("--")
 
+// newMultipartContent creates an empty multipartContent.  If preamble is
+// empty the body will begin with the first delimiter.
 func newMultipartContent(boundary, preamble string) *multipartContent {
 	mp := new(multipartContent)
-	mp.preamble = []byte(preamble)
+	if preamble != "" {
+		mp.preamble = []byte(preamble)
+	}
 	mp.boundary = []byte(boundary)
+	mp.eol = crlf
 	mp.parts = []*MessagePart{}
 	return mp
 }
@@ -42,31 +68,74 @@ func (mp *multipartContent) addPart(p *MessagePart) {
 	mp.parts = append(mp.parts, p)
 }
 
-func (m *Message) extractMultiparts() error {
+func (m *MessagePart) extractMultiparts(ctx *parseContext, path []int) error {
 	body := []byte(m.Body)
 	boundary, ok := m.ctParams["boundary"]
 	if !ok {
-		return errors.New("cannot extract multiparts, no boundary parameter")
+		return ctx.recover(path, errors.New("cannot extract multiparts, no boundary parameter"))
 	}
-	delim := []byte("\r\n--" + boundary)
-	preamble, _, err := extractPart(&body, delim[2:])
-	if err != nil {
+	if err := checkLimit("MaxDepth", ctx.limits.MaxDepth, ctx.depth+len(path)+1); err != nil {
 		return err
 	}
-	mp := newMultipartContent(boundary, string(preamble))
-	for {
-		p, last, err := extractPart(&body, delim)
-		if err != nil {
+	dashBoundary := []byte("--" + boundary)
+	mp := newMultipartContent(boundary, "")
+	mp.eol = detectLineEnding(body)
+	startsWithDelimiter := bytes.HasPrefix(body, dashBoundary)
+	preamble, preambleEOL, padding, last, err := extractPart(&body, dashBoundary)
+	if err != nil {
+		return ctx.recover(path, errors.New("cannot extract multiparts, no boundary delimiter found"))
+	}
+	if len(preamble) > 0 || !startsWithDelimiter {
+		mp.preamble = preamble
+		mp.preambleEOL = preambleEOL
+	}
+	if last {
+		// The first delimiter is the closing delimiter, so there are no
+		// sections
+		mp.epilogue = append([]byte{}, body...)
+		m.mpContent = mp
+		return nil
+	}
+	for i := 0; ; i++ {
+		partPath := appendPath(path, i)
+		ctx.parts++
+		if err := checkLimit("MaxParts", ctx.limits.MaxParts, ctx.parts); err != nil {
 			return err
 		}
+		p, eol, nextPadding, last, err := extractPart(&body, dashBoundary)
+		if err != nil {
+			if err := ctx.recover(path, errors.New("closing boundary delimiter not found")); err != nil {
+				return err
+			}
+			mp.unclosed = true
+			if i > 0 && len(bytes.TrimSpace(body)) == 0 {
+				// Nothing follows the last delimiter
+				mp.trailer = append(append(append([]byte{}, dashBoundary...), padding...), body...)
+				m.mpContent = mp
+				return nil
+			}
+			// Everything up to the end of the body belongs to the last part,
+			// apart from a closing delimiter truncated before its dashes
+			p, eol, last, body = body, nil, true, nil
+			if idx := bytes.LastIndex(p, dashBoundary); idx != -1 && (idx == 0 || p[idx-1] == '\n') &&
+				len(bytes.TrimSpace(p[idx+len(dashBoundary):])) == 0 {
+				mp.trailer = p[idx:]
+				p, eol = splitLineEnding(p[:idx])
+			}
+		}
 
-		r := NewReader(string(p))
-		part, err := r.ReadMessagePart()
+		part, err := readPart(p, ctx, partPath)
 		if err != nil {
-			return errors.New("failed to extract multiparts: " + err.Error())
+			return err
 		}
 
+		part.boundaryPadding = padding
+		part.boundaryEOL = append([]byte{}, eol...)
+		padding = nextPadding
 		mp.parts = append(mp.parts, part)
+		if last && body != nil {
+			mp.epilogue = append([]byte{}, body...)
+		}
 		if last {
 			m.mpContent = mp
 			return nil
@@ -74,7 +143,39 @@ func (m *Message) extractMultiparts() error {
 	}
 }
 
-func (m *Message) AddMultipart(p *MessagePart) {
+// readPart parses the text of a multipart section, including any nested
+// multipart sections.
+func readPart(text []byte, ctx *parseContext, path []int) (*MessagePart, error) {
+	r := NewReader(string(text))
+	r.Limits = ctx.limits
+	r.ctx = ctx
+	part, err := r.readMessagePart(path)
+	if err == nil {
+		return part, nil
+	}
+	if _, ok := err.(ProtocolError); !ok && err != io.EOF {
+		return nil, err
+	}
+	if err := ctx.recover(path, errors.New("failed to extract multiparts: "+err.Error())); err != nil {
+		return nil, err
+	}
+	// Keep the section content as a body without headers
+	part = new(MessagePart)
+	part.rawContent = r.content
+	part.Body = string(text)
+	part.depth = ctx.depth + len(path)
+	part.headerless = true
+	return part, nil
+}
+
+func appendPath(path []int, i int) []int {
+	p := make([]int, len(path)+1)
+	copy(p, path)
+	p[len(path)] = i
+	return p
+}
+
+func (m *MessagePart) AddMultipart(p *MessagePart) {
 	if m.mpContent == nil {
 		boundary := randomBoundary()
 		m.mpContent = newMultipartContent(boundary, "")
@@ -82,69 +183,289 @@ func (m *Message) AddMultipart(p *MessagePart) {
 	m.mpContent.addPart(p)
 }
 
-func (m *Message) ClearMultiparts() {
+func (m *MessagePart) ClearMultiparts() {
 	if m.mpContent != nil {
 		m.mpContent.parts = nil
 		m.mpContent.preamble = nil
+		m.mpContent.preambleEOL = nil
+		m.mpContent.epilogue = nil
+		m.mpContent.unclosed = false
+		m.mpContent.trailer = nil
 	}
 }
 
-func (m *Message) PackMultiparts() error {
+// PackMultiparts renders the multipart sections of m, including any nested
+// multipart sections, into Body.
+func (m *MessagePart) PackMultiparts() error {
+	return m.packMultiparts(false)
+}
+
+// packMultiparts renders the multipart sections of m into Body.  The body
+// of a nested multipart section does not end with a line ending, as the
+// line ending before the next delimiter of the enclosing part follows it.
+func (m *MessagePart) packMultiparts(nested bool) error {
 	if m.mpContent == nil {
 		return errors.New("not a multipart message")
 	}
-	m.Body = renderMultiparts(m.mpContent)
+	for _, p := range m.mpContent.parts {
+		if p.mpContent != nil {
+			if err := p.packMultiparts(true); err != nil {
+				return err
+			}
+			p.rawContent = []byte(p.String())
+		}
+	}
+	m.Body = renderMultiparts(m.mpContent, nested)
+	return nil
+}
+
+// Parts returns the sections of a multipart message part, or nil if m is
+// not multipart.
+func (m *MessagePart) Parts() []*MessagePart {
+	if m.mpContent == nil {
+		return nil
+	}
+	return m.mpContent.parts
+}
+
+// Preamble returns the text before the first boundary delimiter of a
+// multipart part.
+func (m *MessagePart) Preamble() string {
+	if m.mpContent == nil {
+		return ""
+	}
+	return string(m.mpContent.preamble)
+}
+
+// SetPreamble sets the text to be rendered by PackMultiparts before the
+// first boundary delimiter of a multipart part.
+func (m *MessagePart) SetPreamble(preamble string) {
+	if m.mpContent == nil {
+		return
+	}
+	if preamble == "" {
+		m.mpContent.preamble = nil
+	} else {
+		m.mpContent.preamble = []byte(preamble)
+	}
+}
+
+// Epilogue returns the text following the line of the closing boundary
+// delimiter of a multipart part.
+func (m *MessagePart) Epilogue() string {
+	if m.mpContent == nil {
+		return ""
+	}
+	_, epilogue := m.mpContent.splitEpilogue()
+	return string(epilogue)
+}
+
+// SetEpilogue sets the text to be rendered by PackMultiparts after the line
+// of the closing boundary delimiter of a multipart part.  Any transport
+// padding on the delimiter line is kept.
+func (m *MessagePart) SetEpilogue(epilogue string) {
+	if m.mpContent == nil {
+		return
+	}
+	if m.mpContent.epilogue == nil && epilogue == "" {
+		return
+	}
+	line, _ := m.mpContent.splitEpilogue()
+	if epilogue != "" && !bytes.HasSuffix(line, lf) {
+		line = append(append([]byte{}, line...), m.mpContent.eol...)
+	}
+	m.mpContent.epilogue = append(append([]byte{}, line...), epilogue...)
+}
+
+// splitEpilogue separates the remainder of the closing delimiter line from
+// the text which follows it.
+func (mp *multipartContent) splitEpilogue() (line, epilogue []byte) {
+	if mp.epilogue == nil {
+		return mp.eol, nil
+	}
+	idx := bytes.IndexByte(mp.epilogue, '\n')
+	if idx == -1 {
+		return mp.epilogue, nil
+	}
+	return mp.epilogue[:idx+1], mp.epilogue[idx+1:]
+}
+
+// MediaType returns the media type from the Content-Type header of m
+// without parameters, for example "multipart/mixed".  An empty string is
+// returned if there is no valid Content-Type header.
+func (m *MessagePart) MediaType() string {
+	if m.ctPrimary == "" {
+		return ""
+	}
+	return m.ctPrimary + "/" + m.ctSecondary
+}
+
+// ContentTypeParam returns the value of the Content-Type parameter name,
+// or "" if it is not present.
+func (m *MessagePart) ContentTypeParam(name string) string {
+	return m.ctParams[strings.ToLower(name)]
+}
+
+// SkipParts may be returned from a WalkFunc to skip the sections of the
+// multipart part it was called with.
+var SkipParts = errors.New("skip parts")
+
+// WalkFunc is called by Walk for each MessagePart in a message tree.  path
+// holds the index of each section leading to p from the part Walk was
+// called on, which is visited with an empty path.
+type WalkFunc func(path []int, p *MessagePart) error
+
+// Walk calls fn for m and then recursively for every section of m in
+// depth first order.  If fn returns an error other than SkipParts the walk
+// stops and the error is returned.
+func (m *MessagePart) Walk(fn WalkFunc) error {
+	err := m.walk(nil, fn)
+	if err == SkipParts {
+		return nil
+	}
+	return err
+}
+
+// leafParts returns every section of m, at any depth, which is not itself
+// multipart in the order in which they appear in the message.
+func leafParts(m *MessagePart) []*MessagePart {
+	var leaves []*MessagePart
+	m.Walk(func(path []int, p *MessagePart) error {
+		if len(path) > 0 && p.mpContent == nil {
+			leaves = append(leaves, p)
+		}
+		return nil
+	})
+	return leaves
+}
+
+func (m *MessagePart) walk(path []int, fn WalkFunc) error {
+	if err := fn(path, m); err != nil {
+		return err
+	}
+	for i, p := range m.Parts() {
+		if err := p.walk(appendPath(path, i), fn); err != nil && err != SkipParts {
+			return err
+		}
+	}
 	return nil
 }
 
-func renderMultiparts(mp *multipartContent) string {
+func renderMultiparts(mp *multipartContent, nested bool) string {
 	b := new(bytes.Buffer)
-	b.Write(mp.preamble)
-	for _, part := range mp.parts {
-		writeBoundary(b, mp.boundary, false)
+	if mp.preamble != nil {
+		b.Write(mp.preamble)
+		mp.writeEOL(b, mp.preambleEOL)
+	}
+	for i, part := range mp.parts {
+		if i > 0 {
+			mp.writeEOL(b, mp.parts[i-1].boundaryEOL)
+		}
+		if part.boundaryPadding != nil {
+			writeBoundary(b, mp.boundary, false, part.boundaryPadding)
+		} else {
+			writeBoundary(b, mp.boundary, false, mp.eol)
+		}
 		b.WriteString(part.String())
 	}
-	writeBoundary(b, mp.boundary, true)
+	if mp.unclosed {
+		if mp.trailer != nil {
+			mp.writeEOL(b, mp.parts[len(mp.parts)-1].boundaryEOL)
+			b.Write(mp.trailer)
+		}
+		return b.String()
+	}
+	if len(mp.parts) > 0 {
+		mp.writeEOL(b, mp.parts[len(mp.parts)-1].boundaryEOL)
+	}
+	if mp.epilogue != nil {
+		writeBoundary(b, mp.boundary, true, nil)
+		b.Write(mp.epilogue)
+	} else if nested {
+		writeBoundary(b, mp.boundary, true, nil)
+	} else {
+		writeBoundary(b, mp.boundary, true, mp.eol)
+	}
 	return b.String()
 }
 
-func writeBoundary(buffer *bytes.Buffer, boundary []byte, final bool) {
-	if buffer.Len() > 0 {
-		buffer.Write(crlf)
+// writeEOL writes the line ending recorded before a delimiter when the
+// message was parsed, or the line ending of mp if none was recorded.  A
+// delimiter must begin a line, so a recorded empty line ending is only kept
+// when b already ends with a line ending.
+func (mp *multipartContent) writeEOL(b *bytes.Buffer, eol []byte) {
+	if eol == nil || len(eol) == 0 && b.Len() > 0 && b.Bytes()[b.Len()-1] != '\n' {
+		eol = mp.eol
 	}
+	b.Write(eol)
+}
+
+func writeBoundary(buffer *bytes.Buffer, boundary []byte, final bool, eol []byte) {
 	buffer.Write(dashes)
 	buffer.Write(boundary)
 	if final {
 		buffer.Write(dashes)
 	}
-	buffer.Write(crlf)
+	buffer.Write(eol)
 }
 
-func extractPart(messageBody *[]byte, delim []byte) ([]byte, bool, error) {
+// extractPart returns the content of messageBody up to the next delimiter
+// and advances messageBody past the delimiter line.  A delimiter is a line
+// beginning with dashBoundary followed by optional whitespace and a CRLF or
+// LF line ending, or by "--" for the closing delimiter.  The line ending
+// which precedes the delimiter belongs to the delimiter and is returned in
+// eol rather than as part of the content.  padding holds the whitespace and
+// line ending which follow a delimiter that is not the closing delimiter.
+func extractPart(messageBody *[]byte, dashBoundary []byte) (data, eol, padding []byte, last bool, err error) {
 	body := *messageBody
-	idx := bytes.Index(body, delim)
-	if idx == -1 {
-		return nil, false, malformed
-	}
-	data := body[:idx]
-	idx += len(delim)
-	if len(body[idx:]) < 2 {
-		return nil, false, malformed
-	}
-	suffix := body[idx : idx+2]
-	body = body[idx+2:]
-
-	if bytes.Equal(suffix, crlf) {
-		*messageBody = body
-		return data, false, nil
-	} else if bytes.Equal(suffix, dashes) {
-		*messageBody = body
-		return data, true, nil
-	} else {
-		return nil, false, malformed
+	offset := 0
+	for {
+		idx := bytes.Index(body[offset:], dashBoundary)
+		if idx == -1 {
+			return nil, nil, nil, false, malformed
+		}
+		idx += offset
+		offset = idx + len(dashBoundary)
+		if idx > 0 && body[idx-1] != '\n' {
+			continue
+		}
+		rest := body[offset:]
+		last = false
+		if bytes.HasPrefix(rest, dashes) {
+			last = true
+			rest = rest[len(dashes):]
+		} else if rest = skipTransportPadding(rest); bytes.HasPrefix(rest, crlf) {
+			rest = rest[len(crlf):]
+		} else if bytes.HasPrefix(rest, lf) {
+			rest = rest[len(lf):]
+		} else {
+			continue
+		}
+		if !last {
+			padding = body[offset : len(body)-len(rest)]
+		}
+		data, eol = splitLineEnding(body[:idx])
+		*messageBody = rest
+		return data, eol, padding, last, nil
 	}
 }
 
+// skipTransportPadding returns b without the leading spaces and tabs
+// which may follow a boundary delimiter (RFC 2046).
+func skipTransportPadding(b []byte) []byte {
+	return bytes.TrimLeft(b, " \t")
+}
+
+// detectLineEnding returns LF if the first line of body ends with a bare
+// LF and CRLF otherwise.
+func detectLineEnding(body []byte) []byte {
+	idx := bytes.IndexByte(body, '\n')
+	if idx > 0 && body[idx-1] == '\r' || idx == -1 {
+		return crlf
+	}
+	return lf
+}
+
 func randomBoundary() string {
 	var buf [30]byte
 	rnd := rand.Reader
@@ -157,3 +478,102 @@ func randomBoundary() string {
 	}
 	return fmt.Sprintf("%x", buf[:])
 }
+
+// partReader reads a single section of a multipart body from an underlying
+// bufio.Reader, stopping at the next boundary delimiter.  The line ending
+// before a delimiter belongs to the delimiter, so the ending of each line is
+// held back until the following line has been examined.
+type partReader struct {
+	r           *bufio.Reader
+	delim       []byte
+	pending     []byte
+	eol         []byte
+	atLineStart bool
+	done        bool
+	final       bool
+	err         error
+	// lenient treats the end of input as a closing delimiter, setting
+	// truncated when it does so
+	lenient   bool
+	truncated bool
+}
+
+func newPartReader(r *bufio.Reader, boundary []byte) *partReader {
+	pr := new(partReader)
+	pr.r = r
+	pr.delim = append(append([]byte{}, dashes...), boundary...)
+	pr.atLineStart = true
+	return pr
+}
+
+func (pr *partReader) Read(p []byte) (int, error) {
+	for len(pr.pending) == 0 {
+		if pr.done {
+			return 0, io.EOF
+		}
+		if pr.err != nil {
+			return 0, pr.err
+		}
+		pr.fill()
+	}
+	n := copy(p, pr.pending)
+	pr.pending = pr.pending[n:]
+	return n, nil
+}
+
+func (pr *partReader) fill() {
+	line, err := pr.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// Longer than the buffer, so this cannot be a delimiter line
+		pr.pending = append(append(pr.pending[:0], pr.eol...), line...)
+		pr.eol = nil
+		pr.atLineStart = false
+		return
+	}
+	if pr.atLineStart && pr.isDelimiter(line) {
+		pr.done = true
+		pr.final = bytes.HasPrefix(line[len(pr.delim):], dashes)
+		return
+	}
+	if err == io.EOF && pr.lenient {
+		pr.pending = append(append(pr.pending[:0], pr.eol...), line...)
+		pr.eol = nil
+		pr.done, pr.final, pr.truncated = true, true, true
+		return
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = malformed
+		}
+		pr.err = err
+		pr.pending = append(append(pr.pending[:0], pr.eol...), line...)
+		pr.eol = nil
+		return
+	}
+	content, eol := splitLineEnding(line)
+	pr.pending = append(append(pr.pending[:0], pr.eol...), content...)
+	pr.eol = append(pr.eol[:0], eol...)
+	pr.atLineStart = true
+}
+
+func (pr *partReader) isDelimiter(line []byte) bool {
+	if !bytes.HasPrefix(line, pr.delim) {
+		return false
+	}
+	suffix := line[len(pr.delim):]
+	if !bytes.HasPrefix(suffix, dashes) {
+		suffix = skipTransportPadding(suffix)
+	}
+	return bytes.HasPrefix(suffix, crlf) || bytes.HasPrefix(suffix, lf) || bytes.HasPrefix(suffix, dashes)
+}
+
+// splitLineEnding splits line into its content and its trailing CRLF or LF
+func splitLineEnding(line []byte) ([]byte, []byte) {
+	if bytes.HasSuffix(line, crlf) {
+		return line[:len(line)-2], line[len(line)-2:]
+	}
+	if bytes.HasSuffix(line, []byte("\n")) {
+		return line[:len(line)-1], line[len(line)-1:]
+	}
+	return line, nil
+}
@@ -1,6 +1,10 @@
 package pgpmail
 
-import "testing"
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
 
 func TestExtract(t *testing.T) {
 	td := new(TestData)
@@ -33,5 +37,297 @@ Content-Type: text/html; charset=UTF-8
 
 <div dir="ltr">1234</div>
 
---001a11c167c8f1cb3104f8f4c019--
-`)
+--001a11c167c8f1cb3104f8f4c019--`)
+
+var nestedAlternativePart = `Content-Type: multipart/alternative; boundary=nested0123
+
+--nested0123
+Content-Type: text/plain; charset=UTF-8
+
+Nested plain text.
+--nested0123
+Content-Type: text/html; charset=UTF-8
+
+<div>Nested html.</div>
+--nested0123--`
+
+var attachmentPart = `Content-Type: application/octet-stream; name="data.bin"
+Content-Disposition: attachment; filename="data.bin"
+
+attachment data`
+
+func TestExtractNested(t *testing.T) {
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{nestedAlternativePart, attachmentPart}
+	m := td.Message()
+
+	ps := m.Parts()
+	if len(ps) != 2 {
+		t.Fatalf("expecting 2 top level parts, got %d", len(ps))
+	}
+	if ps[0].MediaType() != "multipart/alternative" {
+		t.Errorf("unexpected media type for nested part: %s", ps[0].MediaType())
+	}
+	nested := ps[0].Parts()
+	if len(nested) != 2 {
+		t.Fatalf("expecting 2 nested parts, got %d", len(nested))
+	}
+	if nested[0].Body != "Nested plain text." {
+		t.Errorf("nested part body does not match: %q", nested[0].Body)
+	}
+	if nested[1].ContentTypeParam("Charset") != "UTF-8" {
+		t.Error("nested part content type parameter not parsed")
+	}
+
+	var paths [][]int
+	var types []string
+	m.Walk(func(path []int, p *MessagePart) error {
+		paths = append(paths, path)
+		types = append(types, p.MediaType())
+		return nil
+	})
+	expectedTypes := []string{"multipart/mixed", "multipart/alternative", "text/plain", "text/html", "application/octet-stream"}
+	if strings.Join(types, ",") != strings.Join(expectedTypes, ",") {
+		t.Errorf("walk visited unexpected parts: %v", types)
+	}
+	if fmt.Sprint(paths) != "[[] [0] [0 0] [0 1] [1]]" {
+		t.Errorf("walk produced unexpected paths: %v", paths)
+	}
+
+	var visited int
+	m.Walk(func(path []int, p *MessagePart) error {
+		visited++
+		if p.MediaType() == "multipart/alternative" {
+			return SkipParts
+		}
+		return nil
+	})
+	if visited != 3 {
+		t.Errorf("expecting SkipParts to leave 3 parts visited, got %d", visited)
+	}
+}
+
+func TestPackNested(t *testing.T) {
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{nestedAlternativePart, attachmentPart}
+	m := td.Message()
+	m.Parts()[0].Parts()[0].Body = "Modified nested text."
+	m.PackMultiparts()
+
+	m2, err := ParseMessage(m.String())
+	if err != nil {
+		t.Fatal("error parsing packed message: " + err.Error())
+	}
+	if body := m2.Parts()[0].Parts()[0].Body; body != "Modified nested text." {
+		t.Errorf("modified nested part not packed into message body: %q", body)
+	}
+}
+
+func TestExtractLF(t *testing.T) {
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Preamble = "Preamble text."
+	td.Parts = []string{nestedAlternativePart, plainPart}
+	msg := strings.Replace(td.String(), "\r\n", "\n", -1)
+
+	m, err := ParseMessage(msg)
+	if err != nil {
+		t.Fatal("error parsing LF message: " + err.Error())
+	}
+	if len(m.Parts()) != 2 || len(m.Parts()[0].Parts()) != 2 {
+		t.Fatal("LF multipart message not split into parts")
+	}
+	if m.Parts()[1].Body != "This is a test multipart message." {
+		t.Errorf("LF part body does not match: %q", m.Parts()[1].Body)
+	}
+	if m.String() != msg {
+		t.Error("LF message does not render to original text")
+	}
+
+	m.Parts()[1].Body = "Modified."
+	m.Parts()[1].SetHeader("X-Added", "yes")
+	m.PackMultiparts()
+	if strings.Contains(m.String(), "\r") {
+		t.Error("modified LF message contains CR characters")
+	}
+	if !strings.Contains(m.String(), "X-Added: yes\n\nModified.\n--001a11c167c8f1cb3104f8f4c019--") {
+		t.Errorf("modified LF message not rendered with LF line endings:\n%s", m.String())
+	}
+}
+
+func TestPackMixedLineEndings(t *testing.T) {
+	// Only the delimiter after the first section is preceded by CRLF
+	msg := "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: text/plain\n\nOne\r\n" +
+		"--b\nContent-Type: text/html\n\n<p>Two</p>\n\n--b--\n"
+	m, err := NewReader(msg).ReadMessage()
+	if err != nil {
+		t.Fatal("error parsing message with mixed line endings: " + err.Error())
+	}
+	m.Parts()[1].Body = "Modified."
+	m.PackMultiparts()
+	expected := strings.Replace(msg, "<p>Two</p>\n", "Modified.", 1)
+	if m.String() != expected {
+		t.Errorf("line endings before delimiters not preserved:\n%q\n%q", expected, m.String())
+	}
+}
+
+func createLenientTestMessage(closing string) string {
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{plainPart, htmlPart}
+	msg := td.String()
+	return strings.TrimSuffix(msg, "--001a11c167c8f1cb3104f8f4c019--") + closing
+}
+
+func readLenient(t *testing.T, msg string) (*Message, []ParseWarning) {
+	r := NewReader(msg)
+	r.Lenient = true
+	m, err := r.ReadMessage()
+	if err != nil {
+		t.Fatal("unexpected error reading message in lenient mode: " + err.Error())
+	}
+	return m, r.Warnings()
+}
+
+func TestExtractMissingClose(t *testing.T) {
+	msg := createLenientTestMessage("")
+	m, err := NewReader(msg).ReadMessage()
+	if err == nil {
+		t.Error("expecting error for missing closing boundary")
+	}
+	if m == nil || m.GetHeaderValue("Subject") == "" || m.Body == "" {
+		t.Error("message not returned along with error for missing closing boundary")
+	}
+	if m, err := ParseMessage(msg); err != nil || len(m.Parts()) != 2 {
+		t.Errorf("ParseMessage did not recover parts from message without closing boundary: %v", err)
+	}
+	m, ws := readLenient(t, msg)
+	if len(ws) != 1 || !strings.Contains(ws[0].Message, "closing boundary") {
+		t.Errorf("expecting closing boundary warning, got %v", ws)
+	}
+	if len(m.Parts()) != 2 || !strings.HasPrefix(m.Parts()[1].Body, "<div dir=\"ltr\">1234</div>") {
+		t.Fatal("parts not recovered from message without closing boundary")
+	}
+
+	for _, closing := range []string{"--001a11c167c8f1cb3104f8f4c019", "--001a11c167c8f1cb3104f8f4c019\r\n"} {
+		m, ws = readLenient(t, createLenientTestMessage(closing))
+		if len(ws) != 1 || len(m.Parts()) != 2 {
+			t.Fatalf("parts not recovered from message with truncated closing boundary: %v", ws)
+		}
+		if m.Parts()[1].Body != "<div dir=\"ltr\">1234</div>\r\n" {
+			t.Errorf("truncated closing boundary included in last part: %q", m.Parts()[1].Body)
+		}
+	}
+
+	// No closing delimiter is added when the message is packed again
+	for _, closing := range []string{"", "--001a11c167c8f1cb3104f8f4c019", "--001a11c167c8f1cb3104f8f4c019\r\n"} {
+		msg = createLenientTestMessage(closing)
+		m, _ = readLenient(t, msg)
+		m.PackMultiparts()
+		if m.String() != msg {
+			t.Errorf("message without closing boundary changed by packing:\n%q", m.String())
+		}
+	}
+}
+
+func TestExtractEpilogue(t *testing.T) {
+	msg := createLenientTestMessage("--001a11c167c8f1cb3104f8f4c019--  \r\nThis is the epilogue.\r\n")
+	m, err := ParseMessage(msg)
+	if err != nil {
+		t.Fatal("error parsing message with epilogue: " + err.Error())
+	}
+	if m.Epilogue() != "This is the epilogue.\r\n" {
+		t.Errorf("unexpected epilogue: %q", m.Epilogue())
+	}
+	m.PackMultiparts()
+	if m.String() != msg {
+		t.Errorf("epilogue not preserved:\n%s", m.String())
+	}
+
+	m.SetEpilogue("Replaced.\r\n")
+	m.PackMultiparts()
+	if !strings.HasSuffix(m.Body, "--001a11c167c8f1cb3104f8f4c019--  \r\nReplaced.\r\n") {
+		t.Errorf("epilogue not replaced:\n%s", m.Body)
+	}
+
+	// Nothing, or only a line ending, after the closing delimiter is kept
+	for _, closing := range []string{"--001a11c167c8f1cb3104f8f4c019--", "--001a11c167c8f1cb3104f8f4c019--\n"} {
+		msg = createLenientTestMessage(closing)
+		if m, err = NewReader(msg).ReadMessage(); err != nil {
+			t.Fatal("error parsing message: " + err.Error())
+		}
+		m.PackMultiparts()
+		if m.String() != msg {
+			t.Errorf("text after closing delimiter not preserved:\n%q", m.String())
+		}
+	}
+}
+
+func TestExtractTransportPadding(t *testing.T) {
+	msg := strings.Replace(createLenientTestMessage("--001a11c167c8f1cb3104f8f4c019--\r\n"),
+		"4c019\r\n", "4c019 \t\r\n", -1)
+	m, err := ParseMessage(msg)
+	if err != nil {
+		t.Fatal("error parsing message with transport padding: " + err.Error())
+	}
+	if len(m.Parts()) != 2 {
+		t.Fatalf("expecting 2 parts, got %d", len(m.Parts()))
+	}
+	m.Parts()[1].SetHeader("X-Added", "yes")
+	m.PackMultiparts()
+	expected := strings.Replace(msg, "Content-Type: text/html; charset=UTF-8\r\n",
+		"Content-Type: text/html; charset=UTF-8\r\nX-Added: yes\r\n", 1)
+	if m.String() != expected {
+		t.Errorf("transport padding not preserved:\n%s", m.String())
+	}
+}
+
+func TestExtractLenientFailures(t *testing.T) {
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{"Content-Type text/plain\n\nbad header", plainPart}
+	msg := td.String()
+	if _, err := NewReader(msg).ReadMessage(); err == nil {
+		t.Error("expecting error for malformed part header")
+	}
+	m, ws := readLenient(t, msg)
+	if len(ws) != 1 || fmt.Sprint(ws[0].Path) != "[0]" {
+		t.Errorf("expecting warning for first part, got %v", ws)
+	}
+	if len(m.Parts()) != 2 || !strings.Contains(m.Parts()[0].Body, "bad header") {
+		t.Error("malformed part not kept as body")
+	}
+	m.Parts()[1].SetHeader("X-Added", "yes")
+	m.PackMultiparts()
+	if !strings.Contains(m.Body, "--001a11c167c8f1cb3104f8f4c019\r\nContent-Type text/plain") {
+		t.Errorf("malformed part not rendered as original text:\n%s", m.Body)
+	}
+
+	msg = strings.Replace(msg, "; boundary=001a11c167c8f1cb3104f8f4c019", "", 1)
+	msg = strings.Replace(msg, "multipart/mixed", "multipart/signed", 1)
+	m, ws = readLenient(t, msg)
+	if len(ws) != 1 || m.Parts() != nil {
+		t.Errorf("expecting warning and no parts for missing boundary parameter, got %v", ws)
+	}
+	if status := m.Verify(testKeys); status.Code != VerifyFailed {
+		t.Errorf("expecting VerifyFailed for multipart/signed without parts, got %v", status.Code)
+	}
+}
+
+func TestExtractNoParts(t *testing.T) {
+	msg := "Content-Type: multipart/mixed; boundary=b\r\n\r\nPreamble.\r\n--b--\r\nEpilogue.\r\n"
+	m, err := NewReader(msg).ReadMessage()
+	if err != nil {
+		t.Fatal("error reading multipart message without sections: " + err.Error())
+	}
+	if len(m.Parts()) != 0 || m.Preamble() != "Preamble." || m.Epilogue() != "Epilogue.\r\n" {
+		t.Errorf("unexpected structure for multipart message without sections: %d %q %q",
+			len(m.Parts()), m.Preamble(), m.Epilogue())
+	}
+	m.PackMultiparts()
+	if m.String() != msg {
+		t.Errorf("multipart message without sections not preserved:\n%s", m.String())
+	}
+}
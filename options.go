@@ -2,38 +2,89 @@ package pgpmail
 
 import (
 	"io"
+	"sync"
 
 	"code.google.com/p/go.crypto/openpgp/packet"
 )
 
-// encryptToSelf enables also encrypting every email message to the public key of the sender
-var encryptToSelf = true
+// defaults holds the settings configured with the package level Set
+// functions, which are used by the operations on Message.
+var defaults = Options{
+	EncryptToSelf:           true,
+	ProcessInlineEncrypted:  true,
+	ProcessInlineSignatures: true,
+	UseCombinedSignatures:   true,
+	Limits:                  DefaultLimits,
+}
 
-// processInlineEncrypted enables searching inside messages for pgp encrypted message content and processing it
-var processInlineEncrypted = true
+// defaultsMu guards defaults, which may be changed while messages are
+// processed in other goroutines.
+var defaultsMu sync.RWMutex
 
-// processInlineSignatures enables processing of clear-signed message signatures
-var processInlineSignatures = true
+var testingRandHook io.Reader
 
-// useCombinedSignatures enables applying signatures to encrypted messages rather than creating signatures separately
-var useCombinedSignatures = true
+// Options holds the settings which control how messages are encrypted,
+// signed, decrypted and verified by a Processor.  The operations on Message
+// use the settings returned by DefaultOptions.
+type Options struct {
+	// EncryptToSelf enables also encrypting every email message to the public key of the sender
+	EncryptToSelf bool
+	// ProcessInlineEncrypted enables searching inside messages for pgp encrypted message content and processing it
+	ProcessInlineEncrypted bool
+	// ProcessInlineSignatures enables processing of clear-signed message signatures
+	ProcessInlineSignatures bool
+	// ProcessEmbeddedMessages enables decrypting and verifying message/rfc822 parts
+	ProcessEmbeddedMessages bool
+	// EncryptToAllKeys enables encrypting to every valid public key of each recipient rather than only the newest
+	EncryptToAllKeys bool
+	// UseCombinedSignatures enables applying signatures to encrypted messages rather than creating signatures separately
+	UseCombinedSignatures bool
+	// Limits bounds the resources used to decode, decrypt and parse message content, including embedded messages
+	Limits Limits
+	// Config is passed to the openpgp package, which uses its defaults if it is nil
+	Config *packet.Config
+}
 
-var openpgpConfig *packet.Config
+// DefaultOptions returns a copy of the settings configured with the package
+// level Set functions.
+func DefaultOptions() *Options {
+	defaultsMu.RLock()
+	defer defaultsMu.RUnlock()
+	opts := defaults
+	return &opts
+}
 
-var testingRandHook io.Reader
+// setDefault changes the package level settings with fn.
+func setDefault(fn func(opts *Options)) {
+	defaultsMu.Lock()
+	defer defaultsMu.Unlock()
+	fn(&defaults)
+}
 
 func SetEncryptToSelf(v bool) {
-	encryptToSelf = v
+	setDefault(func(opts *Options) { opts.EncryptToSelf = v })
 }
 
 func SetProcessInlineEncrypted(v bool) {
-	processInlineEncrypted = v
+	setDefault(func(opts *Options) { opts.ProcessInlineEncrypted = v })
 }
 
 func SetProcessInlineSignatures(v bool) {
-	processInlineSignatures = v
+	setDefault(func(opts *Options) { opts.ProcessInlineSignatures = v })
+}
+
+func SetProcessEmbeddedMessages(v bool) {
+	setDefault(func(opts *Options) { opts.ProcessEmbeddedMessages = v })
+}
+
+func SetParserLimits(l Limits) {
+	setDefault(func(opts *Options) { opts.Limits = l })
+}
+
+func SetEncryptToAllKeys(v bool) {
+	setDefault(func(opts *Options) { opts.EncryptToAllKeys = v })
 }
 
 func SetUseCombinedSignatures(v bool) {
-	useCombinedSignatures = v
+	setDefault(func(opts *Options) { opts.UseCombinedSignatures = v })
 }
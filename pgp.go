@@ -1,6 +1,7 @@
 package pgpmail
 
 import (
+	"bytes"
 	"strings"
 
 	"code.google.com/p/go.crypto/openpgp"
@@ -21,89 +22,10 @@ type KeySource interface {
 	GetSecretKeyRing() openpgp.EntityList
 }
 
-type KeyRing struct {
-	pubkeys openpgp.EntityList
-	seckeys openpgp.EntityList
-}
-
-func (kr *KeyRing) AddPublicKey(k *openpgp.Entity) {
-	kr.pubkeys = append(kr.pubkeys, k)
-}
-
-func (kr *KeyRing) AddSecretKey(k *openpgp.Entity) {
-	kr.seckeys = append(kr.seckeys, k)
-}
-
-func (kr *KeyRing) GetPublicKeyRing() openpgp.EntityList {
-	return kr.pubkeys
-}
-
-func (kr *KeyRing) GetPublicKey(address string) (*openpgp.Entity, error) {
-	return firstKeyByEmail(address, kr.pubkeys), nil
-}
-
-func (kr *KeyRing) GetAllPublicKeys(address string) (openpgp.EntityList, error) {
-	return keysByEmail(address, kr.pubkeys), nil
-}
-
-func (kr *KeyRing) GetPublicKeyById(keyid uint64) *openpgp.Entity {
-	return keyById(keyid, kr.pubkeys)
-}
-
-func (kr *KeyRing) GetSecretKeyRing() openpgp.EntityList {
-	return kr.seckeys
-}
-
-func (kr *KeyRing) GetSecretKey(address string) (*openpgp.Entity, error) {
-	return firstKeyByEmail(address, kr.seckeys), nil
-}
-
-func (kr *KeyRing) GetAllSecretKeys(address string) (openpgp.EntityList, error) {
-	return keysByEmail(address, kr.seckeys), nil
-}
-
-func (kr *KeyRing) GetSecretKeyById(keyid uint64) *openpgp.Entity {
-	return keyById(keyid, kr.seckeys)
-}
-
-func keyById(keyid uint64, keys openpgp.EntityList) *openpgp.Entity {
-	ks := keys.KeysById(keyid)
-	if len(ks) == 0 {
-		return nil
-	}
-	return ks[0].Entity
-}
-
-func firstKeyByEmail(email string, keys openpgp.EntityList) *openpgp.Entity {
-	ks := keysByEmail(email, keys)
-	if len(ks) == 0 {
-		return nil
-	}
-	return ks[0]
-}
-
-func keysByEmail(email string, keys openpgp.EntityList) openpgp.EntityList {
-	var matching openpgp.EntityList
-	for _, e := range keys {
-		if matchesEmail(email, e) {
-			matching = append(matching, e)
-		}
-	}
-	return matching
-}
-
-func matchesEmail(email string, e *openpgp.Entity) bool {
-	for _, v := range e.Identities {
-		if v.UserId.Email == email {
-			return true
-		}
-	}
-	return false
-}
-
 func createBodyMimePart(m *Message) *MessagePart {
 	p := new(MessagePart)
-	p.Body = m.Body
+	// RFC 3156 requires signed and encrypted content in canonical CRLF form
+	p.Body = insertCR(m.Body)
 	moveHeader(m, p, ctHeader, "text/plain")
 	moveHeader(m, p, cteHeader, "")
 	p.rawContent = []byte(p.String())
@@ -127,3 +49,12 @@ func insertCR(s string) string {
 	}
 	return strings.Join(lines, "\r\n")
 }
+
+// convertLineEndings returns s with all CRLF and LF line endings replaced
+// with eol.
+func convertLineEndings(s string, eol []byte) string {
+	if bytes.Equal(eol, crlf) {
+		return insertCR(s)
+	}
+	return strings.Replace(s, "\r\n", string(eol), -1)
+}
@@ -0,0 +1,65 @@
+package pgpmail
+
+// A Processor encrypts, signs, decrypts and verifies messages using its
+// own Options rather than the package level settings, so that different
+// settings can be used for each user or request.  A Processor may be used
+// from multiple goroutines, but the messages passed to it must not be.
+type Processor struct {
+	opts Options
+}
+
+// NewProcessor returns a Processor using a copy of opts.  If opts is nil
+// the settings returned by DefaultOptions are used.
+func NewProcessor(opts *Options) *Processor {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	return &Processor{opts: *opts}
+}
+
+// Options returns a copy of the settings used by p.
+func (p *Processor) Options() Options {
+	return p.opts
+}
+
+func (p *Processor) Encrypt(m *Message, keysrc KeySource) *EncryptStatus {
+	return encryptMessage(m, keysrc, false, "", p.options())
+}
+
+func (p *Processor) EncryptAndSign(m *Message, keysrc KeySource, passphrase string) *EncryptStatus {
+	return encryptMessage(m, keysrc, true, passphrase, p.options())
+}
+
+func (p *Processor) Sign(m *Message, keysrc KeySource, passphrase string) *EncryptStatus {
+	return signWith(m, keysrc, passphrase, p.opts.Config)
+}
+
+func (p *Processor) Decrypt(m *Message, keysrc KeySource) *DecryptionStatus {
+	return p.DecryptWith(m, keysrc, nil)
+}
+
+func (p *Processor) DecryptWith(m *Message, keysrc KeySource, passphrase []byte) *DecryptionStatus {
+	return decryptMessage(m, keysrc, passphrase, p.options())
+}
+
+func (p *Processor) Verify(m *Message, keysrc KeySource) *VerifyStatus {
+	return verifyMessage(m, keysrc, p.options())
+}
+
+// DecodedBody returns the content of part with its Content-Transfer-Encoding
+// removed as for MessagePart.DecodedBody, applying the limits of p.
+func (p *Processor) DecodedBody(part *MessagePart) ([]byte, error) {
+	return part.decodedBody(p.opts.Limits)
+}
+
+// Attachments returns the attachments of m as for MessagePart.Attachments.
+// Their content is decoded applying the limits of p.
+func (p *Processor) Attachments(m *Message) []*Attachment {
+	return m.attachments(p.opts.Limits)
+}
+
+// options returns a copy of the settings of p for a single operation.
+func (p *Processor) options() *Options {
+	opts := p.opts
+	return &opts
+}
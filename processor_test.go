@@ -0,0 +1,133 @@
+package pgpmail
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+func TestProcessorOptions(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ProcessInlineEncrypted = false
+	noInline := NewProcessor(opts)
+	opts.ProcessInlineEncrypted = true
+	inline := NewProcessor(opts)
+	if noInline.Options().ProcessInlineEncrypted {
+		t.Fatal("changing options after creating a Processor changed its settings")
+	}
+
+	td := new(TestData)
+	td.Body = testInlineCiphertext
+	if status := noInline.Decrypt(td.Message(), testKeys); status.Code != DecryptNotEncrypted {
+		t.Errorf("inline message decrypted with ProcessInlineEncrypted disabled, got %d", status.Code)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status := inline.Decrypt(td.Message(), testKeys); status.Code != DecryptSuccess {
+				t.Errorf("inline message did not decrypt, got %d", status.Code)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestProcessorEncryptToSelf(t *testing.T) {
+	td := new(TestData)
+	td.From = "user1@example.com"
+	td.To = "user2@example.com"
+	opts := DefaultOptions()
+	opts.EncryptToSelf = false
+	if as := getRecipientAddresses(td.Message(), opts); len(as) != 1 || as[0] != "user2@example.com" {
+		t.Errorf("unexpected recipients without EncryptToSelf: %v", as)
+	}
+	opts.EncryptToSelf = true
+	if as := getRecipientAddresses(td.Message(), opts); len(as) != 2 || as[1] != "user1@example.com" {
+		t.Errorf("sender not added to recipients with EncryptToSelf: %v", as)
+	}
+}
+
+func TestProcessorLimits(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Limits.MaxDecodedSize = 10
+	td := new(TestData)
+	td.Body = testInlineCiphertext
+	status := NewProcessor(opts).Decrypt(td.Message(), testKeys)
+	if status.Code != DecryptFailed || !strings.Contains(status.FailureMessage, "MaxDecodedSize") {
+		t.Errorf("expecting MaxDecodedSize of Options to be applied, got %d %s", status.Code, status.FailureMessage)
+	}
+	if status := td.Message().Decrypt(testKeys); status.Code != DecryptSuccess {
+		t.Errorf("limits of Processor applied to default settings, got %d", status.Code)
+	}
+}
+
+func TestProcessorDecodeLimits(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Limits.MaxDecodedSize = 10
+	p := NewProcessor(opts)
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{plainPart, `Content-Type: application/octet-stream; name="big.bin"
+Content-Transfer-Encoding: base64
+
+` + encodeBase64Lines(make([]byte, 100))}
+	m := td.Message()
+	part := m.Parts()[1]
+	_, err := p.DecodedBody(part)
+	expectLimitError(t, err, "MaxDecodedSize")
+	if _, err := part.DecodedBody(); err != nil {
+		t.Errorf("limits of Processor applied to default settings: %v", err)
+	}
+
+	as := p.Attachments(m)
+	if len(as) != 1 {
+		t.Fatalf("expecting 1 attachment, got %d", len(as))
+	}
+	r, err := as[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	expectLimitError(t, err, "MaxDecodedSize")
+}
+
+func TestDefaultOptionsConcurrent(t *testing.T) {
+	defer SetParserLimits(DefaultLimits)
+	td := new(TestData)
+	td.Body = "Hello"
+	msg := td.String()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			SetParserLimits(DefaultLimits)
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := ParseMessage(msg); err != nil {
+				t.Error("error parsing message: " + err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestBuilderOptions(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Config = &packet.Config{Time: func() time.Time { return time.Unix(86400, 0).UTC() }}
+	b := &Builder{From: "user1@example.com", Text: "Hello", Options: opts}
+	m, err := b.Build()
+	if err != nil {
+		t.Fatal("error building message: " + err.Error())
+	}
+	if d := m.GetHeaderValue("Date"); d != "Fri, 02 Jan 1970 00:00:00 +0000" {
+		t.Errorf("Date not taken from Options: %s", d)
+	}
+}
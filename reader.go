@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"strings"
 )
@@ -15,18 +17,87 @@ func (p ProtocolError) Error() string {
 	return string(p)
 }
 
+// A ParseWarning describes a problem in the structure of a message which a
+// lenient Reader recovered from.
+type ParseWarning struct {
+	// Path locates the message part containing the problem as described
+	// for Walk
+	Path    []int
+	Message string
+}
+
+func (w ParseWarning) String() string {
+	return fmt.Sprintf("part %v: %s", w.Path, w.Message)
+}
+
+// parseContext holds the settings for extracting a message tree and
+// collects the warnings produced while doing so.
+type parseContext struct {
+	lenient bool
+	limits  Limits
+	// depth is the nesting depth of the message being parsed, which is
+	// greater than zero for embedded messages
+	depth    int
+	parts    int
+	warnings []ParseWarning
+}
+
+// recover records a warning and returns nil if ctx is lenient and
+// otherwise returns err.
+func (ctx *parseContext) recover(path []int, err error) error {
+	if !ctx.lenient {
+		return err
+	}
+	ctx.warnings = append(ctx.warnings, ParseWarning{Path: path, Message: err.Error()})
+	return nil
+}
+
 type Reader struct {
 	content []byte
 	R       *bufio.Reader
 	buf     []byte
+	// Lenient enables recovering what can be found of the structure of a
+	// malformed multipart message rather than returning an error.  The
+	// problems found are available from Warnings.
+	Lenient bool
+	// Limits bounds the resources used to parse a message.  It is
+	// initialized from the Limits of DefaultOptions.
+	Limits Limits
+	ctx    *parseContext
+	// depth is the nesting depth of the message read, as for parseContext
+	depth int
+	// raw accumulates the text of the header being read by ReadMIMEHeader
+	// and headerEnd holds the blank line which ended the last header block
+	raw       []byte
+	headerEnd string
+
+	// boundary is set by ReadMessageHeader when the message being read
+	// is multipart, and part is the section NextPart is positioned on.
+	boundary []byte
+	part     *partReader
 }
 
 func NewReader(s string) *Reader {
 	sr := strings.NewReader(s)
 	br := bufio.NewReader(sr)
-	return &Reader{content: []byte(s), R: br, buf: nil}
+	return &Reader{content: []byte(s), R: br, buf: nil, Limits: DefaultOptions().Limits}
 }
 
+// NewStreamReader returns a Reader which parses a message incrementally
+// from r rather than from a string held in memory.  ReadMessage may still
+// be used to build the complete message tree, but large messages can be
+// processed with bounded memory by calling ReadMessageHeader and then
+// either reading the body from R or iterating over the sections of a
+// multipart body with NextPart.
+func NewStreamReader(r io.Reader) *Reader {
+	return &Reader{R: bufio.NewReader(r), Limits: DefaultOptions().Limits}
+}
+
+// ReadMessage reads a complete message, including the sections of a
+// multipart body.  If the sections cannot be extracted and r is not
+// Lenient, the message is returned without them along with the error, so
+// that its headers and body remain available.  No message is returned if
+// one of the Limits was exceeded.
 func (r *Reader) ReadMessage() (*Message, error) {
 	hs, err := r.ReadMIMEHeader()
 	if err != nil {
@@ -39,20 +110,110 @@ func (r *Reader) ReadMessage() (*Message, error) {
 	m := new(Message)
 	m.rawContent = r.content
 	m.HeaderList = hs
+	m.headerEnd = r.headerEnd
 	m.Body = string(body)
+	m.depth = r.depth
+	m.parseContentType()
+	r.ctx = r.newParseContext()
+	if m.IsMultipart() {
+		if err := m.extractMultiparts(r.ctx, nil); err != nil {
+			if _, ok := err.(*LimitExceededError); ok {
+				return nil, err
+			}
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+// Warnings returns the problems which a Lenient Reader recovered from while
+// reading the last message or message part.
+func (r *Reader) Warnings() []ParseWarning {
+	if r.ctx == nil {
+		return nil
+	}
+	return r.ctx.warnings
+}
+
+func (r *Reader) newParseContext() *parseContext {
+	return &parseContext{lenient: r.Lenient, limits: r.Limits, depth: r.depth}
+}
+
+// ReadMessageHeader reads only the header block of a message and returns
+// a Message with HeaderList and content type populated but with an empty
+// Body.  The unread body remains available from R, or through NextPart
+// if the message is multipart.
+func (r *Reader) ReadMessageHeader() (*Message, error) {
+	hs, err := r.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	m := new(Message)
+	m.HeaderList = hs
+	m.headerEnd = r.headerEnd
 	m.parseContentType()
+	r.ctx = r.newParseContext()
 	if m.IsMultipart() {
-		m.extractMultiparts()
+		if boundary, ok := m.ctParams["boundary"]; ok {
+			r.boundary = []byte(boundary)
+		}
 	}
 	return m, nil
 }
 
+// NextPart advances to the next section of a multipart message body and
+// returns a Reader for it.  The returned Reader is positioned at the start
+// of the section header, so ReadMessageHeader or ReadMessagePart can be
+// called on it, and NextPart again for nested multiparts.  Any unread
+// content of the previous section is discarded.  NextPart returns io.EOF
+// after the closing boundary has been reached.
+func (r *Reader) NextPart() (*Reader, error) {
+	if r.boundary == nil {
+		return nil, errors.New("cannot read parts, not a multipart message")
+	}
+	if r.part == nil {
+		// The first section read is the preamble
+		r.part = newPartReader(r.R, r.boundary)
+	}
+	if _, err := io.Copy(ioutil.Discard, r.part); err != nil {
+		return nil, err
+	}
+	if r.part.truncated {
+		r.ctx.recover(nil, errors.New("closing boundary delimiter not found"))
+	}
+	if r.part.final {
+		return nil, io.EOF
+	}
+	r.ctx.parts++
+	if err := checkLimit("MaxParts", r.Limits.MaxParts, r.ctx.parts); err != nil {
+		return nil, err
+	}
+	r.part = newPartReader(r.R, r.boundary)
+	r.part.lenient = r.Lenient
+	pr := NewStreamReader(r.part)
+	pr.Lenient = r.Lenient
+	pr.Limits = r.Limits
+	return pr, nil
+}
+
 func (r *Reader) ReadMessagePart() (*MessagePart, error) {
+	r.ctx = r.newParseContext()
+	return r.readMessagePart(nil)
+}
+
+func (r *Reader) readMessagePart(path []int) (*MessagePart, error) {
 	part := new(MessagePart)
 	if err := r.populatePart(part); err != nil {
 		return nil, err
 	}
 	part.rawContent = r.content
+	part.depth = r.ctx.depth + len(path)
+	part.parseContentType()
+	if part.IsMultipart() {
+		if err := part.extractMultiparts(r.ctx, path); err != nil {
+			return nil, err
+		}
+	}
 	return part, nil
 }
 
@@ -66,11 +227,13 @@ func (r *Reader) populatePart(part *MessagePart) error {
 		return errors.New("Message body contained embedded null character")
 	}
 	part.HeaderList = hs
+	part.headerEnd = r.headerEnd
 	part.Body = string(body)
 	return nil
 }
 
-func (m *Message) parseContentType() {
+func (m *MessagePart) parseContentType() {
+	m.ctPrimary, m.ctSecondary, m.ctParams = "", "", nil
 	ct := m.GetHeaderValue(ctHeader)
 	if ct == "" {
 		return
@@ -94,8 +257,10 @@ func (r *Reader) ReadMIMEHeader() ([]*Header, error) {
 
 	var hs []*Header
 	for {
+		r.raw = r.raw[:0]
 		kv, err := r.readContinuedLineSlice()
 		if len(kv) == 0 {
+			r.headerEnd = string(r.raw)
 			return hs, err
 		}
 
@@ -119,7 +284,11 @@ func (r *Reader) ReadMIMEHeader() ([]*Header, error) {
 		}
 		value := string(kv[i:])
 
-		hs = append(hs, &Header{key, value})
+		raw := &rawHeader{name: key, value: value, text: string(r.raw)}
+		hs = append(hs, &Header{Name: key, Value: value, raw: raw})
+		if err := checkLimit("MaxHeaders", r.Limits.MaxHeaders, len(hs)); err != nil {
+			return nil, err
+		}
 
 		if err != nil {
 			return hs, err
@@ -155,11 +324,18 @@ func (r *Reader) readContinuedLineSlice() ([]byte, error) {
 	// Read continuation lines.
 	for r.skipSpace() > 0 {
 		line, err := r.readLineSlice()
+		if _, ok := err.(*LimitExceededError); ok {
+			return nil, err
+		}
 		if err != nil {
 			break
 		}
 		r.buf = append(r.buf, ' ')
 		r.buf = append(r.buf, line...)
+		// A header folded across many short lines is bounded as a whole
+		if err := checkLimit("MaxHeaderLineLength", r.Limits.MaxHeaderLineLength, len(r.buf)); err != nil {
+			return nil, err
+		}
 	}
 	return r.buf, nil
 }
@@ -177,6 +353,7 @@ func (r *Reader) skipSpace() int {
 			r.R.UnreadByte()
 			break
 		}
+		r.raw = append(r.raw, c)
 		n++
 	}
 	return n
@@ -201,21 +378,34 @@ func isASCIILetter(b byte) bool {
 	return 'a' <= b && b <= 'z'
 }
 
+// readLineSlice reads a line and returns it without the line ending.  The
+// complete line is appended to raw.
 func (r *Reader) readLineSlice() ([]byte, error) {
 	var line []byte
 	for {
-		l, more, err := r.R.ReadLine()
-		if err != nil {
+		l, err := r.R.ReadSlice('\n')
+		r.raw = append(r.raw, l...)
+		if err == bufio.ErrBufferFull {
+			line = append(line, l...)
+			if err := checkLimit("MaxHeaderLineLength", r.Limits.MaxHeaderLineLength, len(line)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil && len(l) == 0 && line == nil {
 			return nil, err
 		}
 		// Avoid the copy if the first call produced a full line.
-		if line == nil && !more {
-			return l, nil
-		}
-		line = append(line, l...)
-		if !more {
-			break
+		if line == nil {
+			line = l
+		} else {
+			line = append(line, l...)
 		}
+		break
+	}
+	line, _ = splitLineEnding(line)
+	if err := checkLimit("MaxHeaderLineLength", r.Limits.MaxHeaderLineLength, len(line)); err != nil {
+		return nil, err
 	}
 	return line, nil
 }
@@ -1,7 +1,161 @@
 package pgpmail
 
-import "testing"
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
 
 func TestReadMessage(t *testing.T) {
 
 }
+
+func TestStreamReader(t *testing.T) {
+	td := new(TestData)
+	td.MultipartType = "alternative"
+	td.Preamble = "This is the preamble."
+	td.Parts = []string{plainPart, htmlPart}
+	msg := td.String()
+
+	expected := td.Message()
+	m, err := NewStreamReader(strings.NewReader(msg)).ReadMessage()
+	if err != nil {
+		t.Fatal("error reading message from stream: " + err.Error())
+	}
+	if m.String() != expected.String() {
+		t.Error("message read from stream does not match message read from string")
+	}
+	if len(m.mpContent.parts) != len(expected.mpContent.parts) {
+		t.Fatalf("expecting %d parts, got %d", len(expected.mpContent.parts), len(m.mpContent.parts))
+	}
+	for i, p := range m.mpContent.parts {
+		if p.String() != expected.mpContent.parts[i].String() {
+			t.Errorf("part %d read from stream does not match", i)
+		}
+	}
+}
+
+func TestStreamReaderNextPart(t *testing.T) {
+	td := new(TestData)
+	td.MultipartType = "alternative"
+	td.Parts = []string{plainPart, htmlPart}
+	expected := td.Message()
+
+	r := NewStreamReader(strings.NewReader(td.String()))
+	m, err := r.ReadMessageHeader()
+	if err != nil {
+		t.Fatal("error reading message header: " + err.Error())
+	}
+	if !m.IsMultipart() || m.ctSecondary != "alternative" {
+		t.Error("content type not parsed from message header")
+	}
+	if m.Body != "" {
+		t.Error("body should not be read by ReadMessageHeader")
+	}
+	for i := 0; ; i++ {
+		pr, err := r.NextPart()
+		if err == io.EOF {
+			if i != len(expected.mpContent.parts) {
+				t.Errorf("expecting %d parts, got %d", len(expected.mpContent.parts), i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal("error reading next part: " + err.Error())
+		}
+		p, err := pr.ReadMessageHeader()
+		if err != nil {
+			t.Fatal("error reading part header: " + err.Error())
+		}
+		body, _ := ioutil.ReadAll(pr.R)
+		e := expected.mpContent.parts[i]
+		if p.GetHeaderValue(ctHeader) != e.GetHeaderValue(ctHeader) {
+			t.Errorf("part %d header does not match", i)
+		}
+		if string(body) != e.Body {
+			t.Errorf("part %d body does not match: %q", i, body)
+		}
+	}
+}
+
+func TestStreamReaderMissingBoundary(t *testing.T) {
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{plainPart}
+	msg := strings.TrimSuffix(td.String(), "\r\n--001a11c167c8f1cb3104f8f4c019--")
+
+	r := NewStreamReader(strings.NewReader(msg))
+	if _, err := r.ReadMessageHeader(); err != nil {
+		t.Fatal("error reading message header: " + err.Error())
+	}
+	pr, err := r.NextPart()
+	if err != nil {
+		t.Fatal("error reading first part: " + err.Error())
+	}
+	if _, err := ioutil.ReadAll(pr.R); err != malformed {
+		t.Errorf("expecting malformed error for truncated part, got %v", err)
+	}
+}
+
+func TestStreamReaderLF(t *testing.T) {
+	td := new(TestData)
+	td.MultipartType = "alternative"
+	td.Parts = []string{plainPart, htmlPart}
+	msg := strings.Replace(td.String(), "\r\n", "\n", -1)
+
+	expected, err := ParseMessage(msg)
+	if err != nil {
+		t.Fatal("error parsing LF message: " + err.Error())
+	}
+	r := NewStreamReader(strings.NewReader(msg))
+	if _, err := r.ReadMessageHeader(); err != nil {
+		t.Fatal("error reading message header: " + err.Error())
+	}
+	for i, e := range expected.Parts() {
+		pr, err := r.NextPart()
+		if err != nil {
+			t.Fatalf("error reading part %d: %v", i, err)
+		}
+		p, err := pr.ReadMessagePart()
+		if err != nil {
+			t.Fatalf("error reading part %d: %v", i, err)
+		}
+		if p.String() != e.String() {
+			t.Errorf("LF part %d read from stream does not match", i)
+		}
+	}
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Errorf("expecting io.EOF after last part, got %v", err)
+	}
+}
+
+func TestStreamReaderLenient(t *testing.T) {
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{plainPart}
+	msg := strings.TrimSuffix(td.String(), "\r\n--001a11c167c8f1cb3104f8f4c019--")
+
+	r := NewStreamReader(strings.NewReader(msg))
+	r.Lenient = true
+	if _, err := r.ReadMessageHeader(); err != nil {
+		t.Fatal("error reading message header: " + err.Error())
+	}
+	pr, err := r.NextPart()
+	if err != nil {
+		t.Fatal("error reading first part: " + err.Error())
+	}
+	p, err := pr.ReadMessagePart()
+	if err != nil {
+		t.Fatal("error reading truncated part in lenient mode: " + err.Error())
+	}
+	if p.Body != "This is a test multipart message." {
+		t.Errorf("truncated part body does not match: %q", p.Body)
+	}
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Errorf("expecting io.EOF after truncated part, got %v", err)
+	}
+	if len(r.Warnings()) != 1 {
+		t.Errorf("expecting a warning for the missing closing boundary, got %v", r.Warnings())
+	}
+}
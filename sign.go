@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"net/mail"
 
 	"crypto"
 
@@ -16,6 +15,10 @@ const ctHeader = "Content-Type"
 const cteHeader = "Content-Transfer-Encoding"
 
 func (m *Message) Sign(keysrc KeySource, passphrase string) *EncryptStatus {
+	return signWith(m, keysrc, passphrase, DefaultOptions().Config)
+}
+
+func signWith(m *Message, keysrc KeySource, passphrase string, config *packet.Config) *EncryptStatus {
 	signingKey, err := getSigningKey(m, keysrc)
 	if err != nil {
 		if _, ok := err.(NoSignaturePrivateKeyError); ok {
@@ -23,7 +26,7 @@ func (m *Message) Sign(keysrc KeySource, passphrase string) *EncryptStatus {
 		}
 		return createEncryptFailure(err.Error())
 	}
-	err = signMessage(m, passphrase, signingKey)
+	err = signMessage(m, passphrase, signingKey, config)
 	if err != nil {
 		if _, ok := err.(PassphraseNeededError); ok {
 			return &EncryptStatus{Code: StatusFailedPassphraseNeeded}
@@ -32,18 +35,18 @@ func (m *Message) Sign(keysrc KeySource, passphrase string) *EncryptStatus {
 	return &EncryptStatus{Code: StatusSignedOnly, Message: m}
 }
 
-func signMessage(m *Message, passphrase string, signingKey *openpgp.Entity) error {
-	if isSigningKeyLocked(signingKey, passphrase) {
+func signMessage(m *Message, passphrase string, signingKey *openpgp.Entity, config *packet.Config) error {
+	if isSigningKeyLocked(signingKey, passphrase, config) {
 		var e PassphraseNeededError
 		e.KeyIds = append(e.KeyIds, signingKey.PrimaryKey.KeyId)
 		return e
 	}
 	sigBody := createBodyMimePart(m)
-	sig, err := createSignature([]byte(sigBody.String()), signingKey, openpgpConfig)
+	sig, err := createSignature([]byte(sigBody.String()), signingKey, config)
 	if err != nil {
 		return err
 	}
-	return writeMimeSignatureMessage(m, sigBody, sig)
+	return writeMimeSignatureMessage(m, sigBody, sig, config)
 }
 
 func getSigningKey(m *Message, keysrc KeySource) (*openpgp.Entity, error) {
@@ -66,7 +69,7 @@ func getSenderAddress(m *Message) string {
 	if hdr == "" {
 		return ""
 	}
-	as, err := mail.ParseAddressList(hdr)
+	as, err := addressParser.ParseList(hdr)
 	if err != nil {
 		logger.Warning("Failed to parse sender address " + hdr)
 		return ""
@@ -99,9 +102,9 @@ func hashName(hash crypto.Hash) string {
 	panic(fmt.Sprintf("unknown hash %v", hash))
 }
 
-func writeMimeSignatureMessage(m *Message, body *MessagePart, sig string) error {
+func writeMimeSignatureMessage(m *Message, body *MessagePart, sig string, config *packet.Config) error {
 	b := randomBoundary()
-	ct := fmt.Sprintf("multipart/signed; boundary=%s; micalg=pgp-%s; protocol=\"application/pgp-signature\"", b, hashName(openpgpConfig.Hash()))
+	ct := fmt.Sprintf("multipart/signed; boundary=%s; micalg=pgp-%s; protocol=\"application/pgp-signature\"", b, hashName(config.Hash()))
 	m.AddHeader(ctHeader, ct)
 	m.parseContentType()
 	m.mpContent = newMultipartContent(b, "")
@@ -1,6 +1,9 @@
 package pgpmail
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestSign(t *testing.T) {
 	k, _ := testKeys.GetSecretKey("user1@example.com")
@@ -9,7 +12,7 @@ func TestSign(t *testing.T) {
 	m := td.Message()
 	m.SetHeader(ctHeader, "text/plain; charset=us-ascii")
 	sigBodyPart := createBodyMimePart(m)
-	sig, _ := createSignature(sigBodyPart.rawContent, k, openpgpConfig)
+	sig, _ := createSignature(sigBodyPart.rawContent, k, DefaultOptions().Config)
 	if sig != testExpectedSigUser1 {
 		t.Error("Signature is not expected value")
 	}
@@ -128,3 +131,39 @@ func TestUnsignedMessage(t *testing.T) {
 		t.Error("Unsigned message did not return VerifyUnsigned as expected")
 	}
 }
+
+func TestVerifyEmbedded(t *testing.T) {
+	SetProcessEmbeddedMessages(true)
+	defer SetProcessEmbeddedMessages(false)
+
+	td := new(TestData)
+	td.MultipartType = "mixed"
+	td.Parts = []string{plainPart, "Content-Type: message/rfc822\r\n\r\n" +
+		"From: user1@example.com\r\nSubject: Forwarded\r\n" + clearsignData}
+	m := td.Message()
+
+	status := m.Verify(testKeys)
+	if status.Code != VerifyNotSigned {
+		t.Errorf("Expecting outer message to be VerifyNotSigned, got %d", status.Code)
+	}
+	if len(status.Embedded) != 1 || status.Embedded[0].Code != VerifySigValid {
+		t.Errorf("Embedded message signature did not verify: %v", status.Embedded)
+	}
+}
+
+func TestMimeSignLF(t *testing.T) {
+	td := new(TestData)
+	td.From = "user1@example.com"
+	td.Body = "This is a test message.\n"
+	m := td.Message()
+	if ss := m.Sign(testKeys, ""); ss.Code != StatusSignedOnly {
+		t.Fatalf("status is not expected value: %v", ss)
+	}
+	m, err := ParseMessage(strings.Replace(m.String(), "\r\n", "\n", -1))
+	if err != nil {
+		t.Fatal("error parsing LF signed message: " + err.Error())
+	}
+	if status := m.Verify(testKeys); status.Code != VerifySigValid {
+		t.Errorf("Signature on LF message did not verify: %v", status.Code)
+	}
+}
@@ -38,7 +38,7 @@ func init() {
 		return time.Unix(0, 0)
 	}
 	testingRandHook = &determRand{rand.New(rand.NewSource(0))}
-	openpgpConfig = &packet.Config{Rand: testingRandHook, Time: timeHook}
+	defaults.Config = &packet.Config{Rand: testingRandHook, Time: timeHook}
 }
 
 type testData struct {
@@ -110,8 +110,9 @@ func keysByEmail(email string, keys openpgp.EntityList) openpgp.EntityList {
 }
 
 func matchesEmail(email string, e *openpgp.Entity) bool {
+	email = DefaultAddressNormalization.Normalize(email)
 	for _, v := range e.Identities {
-		if v.UserId.Email == email {
+		if DefaultAddressNormalization.Normalize(identityEmail(v)) == email {
 			return true
 		}
 	}
@@ -28,16 +28,28 @@ type VerifyStatus struct {
 	Message        *Message
 	SignerKeyId    uint64
 	FailureMessage string
+	// Embedded holds the status of each message/rfc822 part when
+	// processing of embedded messages is enabled
+	Embedded []*VerifyStatus
 }
 
 func (m *Message) Verify(keysrc KeySource) *VerifyStatus {
+	return verifyMessage(m, keysrc, DefaultOptions())
+}
+
+func verifyMessage(m *Message, keysrc KeySource, opts *Options) *VerifyStatus {
+	var status *VerifyStatus
 	if m.IsMultipart() && m.ctSecondary == "signed" {
-		return verifyMimeSignature(m, keysrc)
+		status = verifyMimeSignature(m, keysrc, opts)
+	} else if opts.ProcessInlineSignatures {
+		status = verifyInlineSignature(m, keysrc, opts)
+	} else {
+		status = new(VerifyStatus)
 	}
-	if processInlineSignatures {
-		return verifyInlineSignature(m, keysrc)
+	if opts.ProcessEmbeddedMessages {
+		status.Embedded = verifyEmbeddedMessages(m, keysrc, opts)
 	}
-	return new(VerifyStatus)
+	return status
 }
 
 func createVerifyFailure(message string) *VerifyStatus {
@@ -47,11 +59,11 @@ func createVerifyFailure(message string) *VerifyStatus {
 	return status
 }
 
-func verifyMimeSignature(m *Message, keysrc KeySource) *VerifyStatus {
+func verifyMimeSignature(m *Message, keysrc KeySource, opts *Options) *VerifyStatus {
 	if !m.IsMultipart() || m.ctSecondary != "signed" {
 		return createVerifyFailure("Not a multipart/signed message")
 	}
-	ps := m.mpContent.parts
+	ps := m.Parts()
 	if len(ps) != 2 {
 		return createVerifyFailure(fmt.Sprintf("cannot extract signature, expecting 2 mime parts, got %d", len(ps)))
 	}
@@ -60,9 +72,12 @@ func verifyMimeSignature(m *Message, keysrc KeySource) *VerifyStatus {
 	if err != nil {
 		return createVerifyFailure("error decoding armored signature: " + err.Error())
 	}
-	status := checkSignature(keysrc, ps[0].rawContent, sigBlock)
+	// The signed part is verified in canonical CRLF form (RFC 3156) so
+	// that messages stored with bare LF line endings still verify
+	signed := []byte(insertCR(string(ps[0].rawContent)))
+	status := checkSignature(keysrc, signed, sigBlock, opts.Config)
 	if isVerifiedSignature(status) {
-		processMimePlaintext(m, ps[0].rawContent)
+		processMimePlaintext(m, ps[0].rawContent, opts.Limits)
 		status.Message = m
 	}
 	return status
@@ -86,7 +101,7 @@ func getIssuerFromSignature(sigReader io.Reader) (uint64, error) {
 	}
 }
 
-func checkSignature(keysrc KeySource, msg []byte, sigBlock *armor.Block) *VerifyStatus {
+func checkSignature(keysrc KeySource, msg []byte, sigBlock *armor.Block, config *packet.Config) *VerifyStatus {
 	if sigBlock.Type != openpgp.SignatureType {
 		return createVerifyFailure("armored signature type is incorrect: " + sigBlock.Type)
 	}
@@ -104,16 +119,16 @@ func checkSignature(keysrc KeySource, msg []byte, sigBlock *armor.Block) *Verify
 	if e != nil {
 		logger.Warning("could not extract issuer id from signature: " + e.Error())
 	}
-	return processCheckSignatureResult(signer, keyId, err)
+	return processCheckSignatureResult(signer, keyId, err, config)
 }
 
-func processCheckSignatureResult(signer *openpgp.Entity, keyid uint64, err error) *VerifyStatus {
+func processCheckSignatureResult(signer *openpgp.Entity, keyid uint64, err error, config *packet.Config) *VerifyStatus {
 	status := new(VerifyStatus)
 	status.SignerKeyId = keyid
 	if err == nil && signer != nil {
 		status.SignerKeyId = signer.PrimaryKey.KeyId
 		status.Code = VerifySigValid
-		if isSignerKeyExpired(signer) {
+		if isSignerKeyExpired(signer, config) {
 			status.Code = VerifyKeyExpired
 		}
 		// XXX Does uid match from address?
@@ -130,29 +145,27 @@ func processCheckSignatureResult(signer *openpgp.Entity, keyid uint64, err error
 	return status
 }
 
-func isSignerKeyExpired(signer *openpgp.Entity) bool {
+func isSignerKeyExpired(signer *openpgp.Entity, config *packet.Config) bool {
 	for _, v := range signer.Identities {
-		return v.SelfSignature.KeyExpired(openpgpConfig.Now())
+		return v.SelfSignature.KeyExpired(config.Now())
 	}
 	return false
 }
 
-func verifyInlineSignature(m *Message, keysrc KeySource) *VerifyStatus {
+func verifyInlineSignature(m *Message, keysrc KeySource, opts *Options) *VerifyStatus {
 	if !m.IsMultipart() {
-		status, plaintext := checkInlineSignature(m.Body, keysrc)
-		if plaintext != nil {
-			m.Body = string(plaintext)
+		status := verifyInlinePart(&m.MessagePart, keysrc, opts)
+		if isVerifiedSignature(status) {
 			status.Message = m
 		}
 		return status
 	}
 
-	for _, p := range m.mpContent.parts {
+	for _, p := range leafParts(&m.MessagePart) {
 		// Only consider the first text/plain section
 		if isTextMimePart(p) {
-			status, plaintext := checkInlineSignature(p.Body, keysrc)
-			if plaintext != nil {
-				p.Body = string(plaintext)
+			status := verifyInlinePart(p, keysrc, opts)
+			if isVerifiedSignature(status) {
 				p.rawContent = []byte(p.String())
 				m.PackMultiparts()
 				status.Message = m
@@ -163,6 +176,25 @@ func verifyInlineSignature(m *Message, keysrc KeySource) *VerifyStatus {
 	return new(VerifyStatus)
 }
 
+// verifyInlinePart checks a clear-signed message in the decoded body of
+// part and replaces the body with the signed plaintext if it verifies.
+func verifyInlinePart(part *MessagePart, keysrc KeySource, opts *Options) *VerifyStatus {
+	body, err := part.decodedBody(opts.Limits)
+	if err != nil {
+		return createVerifyFailure("error decoding inline message part: " + err.Error())
+	}
+	status, block := checkInlineSignature(string(body), keysrc, opts.Config)
+	if block != nil {
+		if err := replaceDecodedBody(part, block.Plaintext); err != nil {
+			return createVerifyFailure("error replacing inline message body: " + err.Error())
+		}
+		if charset := armorCharset(block.ArmoredSignature); charset != "" {
+			setContentTypeParam(part, "charset", charset)
+		}
+	}
+	return status
+}
+
 func isTextMimePart(part *MessagePart) bool {
 	ct := part.GetHeaderValue(ctHeader)
 	if ct == "" {
@@ -175,14 +207,16 @@ func isTextMimePart(part *MessagePart) bool {
 	return mt == "text/plain"
 }
 
-func checkInlineSignature(body string, keysrc KeySource) (*VerifyStatus, []byte) {
+// checkInlineSignature verifies a clear-signed message in body and returns
+// the decoded clearsign block if the signature is valid.
+func checkInlineSignature(body string, keysrc KeySource, config *packet.Config) (*VerifyStatus, *clearsign.Block) {
 	b, _ := clearsign.Decode([]byte(body))
 	if b == nil {
 		return new(VerifyStatus), nil
 	}
-	status := checkSignature(keysrc, b.Bytes, b.ArmoredSignature)
+	status := checkSignature(keysrc, b.Bytes, b.ArmoredSignature, config)
 	if isVerifiedSignature(status) {
-		return status, b.Plaintext
+		return status, b
 	}
 	return status, nil
 }